@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/leisure-tools/server"
+)
+
+const (
+	TOKEN_HEADER  = "X-Leisure-Token"
+	CERT_LIFETIME = 365 * 24 * time.Hour
+)
+
+var ErrUnauthorized = server.NewLeisureError("unauthorized")
+var ErrTls = server.NewLeisureError("tlsFailure")
+
+// authHandler rejects requests without the peer's token or a user's token, either as
+// "Authorization: Bearer TOKEN" or as an X-Leisure-Token API key.
+// A user's token makes the request act as that user's identity, the peer's token has
+// no identity but can link and shut down the peer.
+func authHandler(token string, users map[string]string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get(TOKEN_HEADER)
+		if auth := r.Header.Get("Authorization"); got == "" && strings.HasPrefix(auth, "Bearer ") {
+			got = strings.TrimPrefix(auth, "Bearer ")
+		}
+		for user, userToken := range users {
+			if subtle.ConstantTimeCompare([]byte(got), []byte(userToken)) == 1 {
+				handler.ServeHTTP(w, withIdentity(r, user))
+				return
+			}
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="leisure"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: missing or bad token", ErrUnauthorized))))
+			return
+		}
+		handler.ServeHTTP(w, withPeerAccess(r))
+	})
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listenTcp checks the TCP settings and listens on the peer's TCP port, or takes an
+// inherited listener if there is one, with TLS and token checks if they are configured.
+// It runs before the peer reports that it is ready, so bad settings stop the peer from starting.
+func (cmd *PeerCmd) listenTcp(l *leisure, listener net.Listener, users map[string]string, handler http.Handler) (*http.Server, net.Listener, error) {
+	host := cmd.Bind
+	addr := net.JoinHostPort(cmd.Bind, fmt.Sprint(cmd.Port))
+	if listener != nil {
+		addr = listener.Addr().String()
+		host, _, _ = net.SplitHostPort(addr)
+	}
+	if cmd.Token != "" || len(users) > 0 {
+		handler = authHandler(cmd.Token, users, handler)
+	} else if !isLoopback(host) {
+		return nil, nil, fmt.Errorf("%w: refusing to listen on %s without --token or --users", ErrUnauthorized, addr)
+	}
+	srv := &http.Server{Addr: addr, Handler: handler}
+	if cmd.TlsCert != "" {
+		cert, err := loadCertificate(cmd.TlsCert, cmd.TlsKey, cmd.TlsGenerate, cmd.Bind)
+		if err != nil {
+			return nil, nil, err
+		}
+		srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			return nil, nil, fmt.Errorf("%w: could not listen on %s: %s", ErrSocketFailure, addr, err)
+		}
+	}
+	return l.addServer(srv), listener, nil
+}
+
+// serveTcp serves the TCP port listenTcp opened
+func serveTcp(srv *http.Server, listener net.Listener) {
+	if srv.TLSConfig == nil {
+		logFor(LOG_PEER).Info("running tcp server", "addr", srv.Addr)
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			logFor(LOG_PEER).Error("tcp server error", "addr", srv.Addr, "error", err)
+		}
+		return
+	}
+	logFor(LOG_PEER).Info("running tls server", "addr", srv.Addr)
+	if err := srv.ServeTLS(listener, "", ""); err != http.ErrServerClosed {
+		logFor(LOG_PEER).Error("tls server error", "addr", srv.Addr, "error", err)
+	}
+}
+
+// loadCertificate reads a key pair, generating a self-signed one first if requested and missing
+func loadCertificate(certFile, keyFile string, generate bool, bind string) (tls.Certificate, error) {
+	if keyFile == "" {
+		return tls.Certificate{}, fmt.Errorf("%w: --tls-cert requires --tls-key", ErrTls)
+	}
+	if _, err := os.Stat(certFile); os.IsNotExist(err) && generate {
+		if err := generateCertificate(certFile, keyFile, bind); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return tls.Certificate{}, fmt.Errorf("%w: could not load %s and %s: %s", ErrTls, certFile, keyFile, err)
+	} else {
+		return cert, nil
+	}
+}
+
+// generateCertificate writes a self-signed certificate for localhost, the hostname, and the bind address
+func generateCertificate(certFile, keyFile, bind string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("%w: could not generate key: %s", ErrTls, err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("%w: could not generate serial number: %s", ErrTls, err)
+	}
+	hosts := []string{"localhost", bind}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Leisure peer"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(CERT_LIFETIME),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("%w: could not create certificate: %s", ErrTls, err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("%w: could not encode key: %s", ErrTls, err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return fmt.Errorf("%w: could not write %s: %s", ErrTls, keyFile, err)
+	} else if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("%w: could not write %s: %s", ErrTls, certFile, err)
+	}
+	logFor(LOG_PEER).Info("generated self-signed certificate", "cert", certFile, "key", keyFile)
+	return nil
+}
+
+// tlsClientConfig trusts caFile, if given, in addition to the system roots
+func tlsClientConfig(caFile string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if pemData, err := os.ReadFile(caFile); err != nil {
+			return nil, fmt.Errorf("%w: could not read %s: %s", ErrTls, caFile, err)
+		} else if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("%w: no certificates in %s", ErrTls, caFile)
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
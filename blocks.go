@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/leisure-tools/org"
+	"github.com/leisure-tools/server"
+)
+
+const BLOCKS = server.VERSION + "/blocks/"
+
+var ErrUnknownBlock = server.NewLeisureError("unknownBlock")
+
+// namedBlock is a block with a name in one document
+type namedBlock struct {
+	Document string    `json:"document"`
+	Alias    string    `json:"alias,omitempty"`
+	Chunk    org.OrgId `json:"chunk"`
+	Type     string    `json:"type,omitempty"` // data, code, monitor, or delete
+	Tags     []string  `json:"tags,omitempty"`
+}
+
+// blockName is every block with a name, a duplicate when they are in more than one document,
+// even ones the identity can't view, since monitor topics need unique names
+type blockName struct {
+	Name      string        `json:"name"`
+	Duplicate bool          `json:"duplicate"`
+	Documents []string      `json:"documents"`
+	Blocks    []*namedBlock `json:"blocks"`
+}
+
+// blockOptions finds a block's type and tags, which can come from its headlines
+func blockOptions(chunks *org.OrgChunks, ch org.Chunk) (string, []string) {
+	var opts map[string]string
+	switch blk := ch.(type) {
+	case *org.TableBlock:
+		opts = blk.GetInheritedOptions(chunks, "", "")
+		if !MONITOR_TYPES.Has(opts["type"]) {
+			return "data", strings.Fields(opts["tags"])
+		}
+	case *org.SourceBlock:
+		opts = blk.GetFullOptions(chunks)
+	}
+	return opts["type"], strings.Fields(opts["tags"])
+}
+
+// namedBlocks finds the blocks with a name, or with every name, in the documents the
+// identity can view, called in the service goroutine
+func (l *leisure) namedBlocks(name, user string) []*blockName {
+	idx := l.index
+	names := []string{name}
+	if name == "" {
+		names = make([]string, 0, len(idx.names))
+		for n := range idx.names {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+	}
+	roles := map[string]string{}
+	results := []*blockName{}
+	for _, name := range names {
+		result := &blockName{Name: name, Documents: []string{}, Blocks: []*namedBlock{}}
+		docs := map[string]bool{}
+		for key := range idx.names[name] {
+			docs[key.doc] = true
+			role, ok := roles[key.doc]
+			if !ok {
+				role = l.roleFor(key.doc, user)
+				roles[key.doc] = role
+			}
+			if !hasRole(role, ROLE_VIEWER) {
+				continue
+			}
+			blk := &namedBlock{Document: key.doc, Chunk: key.chunk}
+			if aliases := l.aliasesFor(key.doc); len(aliases) > 0 {
+				blk.Alias = aliases[0]
+			}
+			chunks := idx.docs[key.doc].session.Chunks
+			blk.Type, blk.Tags = blockOptions(chunks, chunks.ChunkIds[key.chunk])
+			result.Blocks = append(result.Blocks, blk)
+		}
+		if len(result.Blocks) == 0 {
+			continue
+		}
+		sort.Slice(result.Blocks, func(i, j int) bool {
+			a, b := result.Blocks[i], result.Blocks[j]
+			return a.Document < b.Document || (a.Document == b.Document && a.Chunk < b.Chunk)
+		})
+		for _, blk := range result.Blocks {
+			if len(result.Documents) == 0 || result.Documents[len(result.Documents)-1] != blk.Document {
+				result.Documents = append(result.Documents, blk.Document)
+			}
+		}
+		result.Duplicate = len(docs) > 1
+		results = append(results, result)
+	}
+	return results
+}
+
+// URL: GET /v1/blocks/ -- every block name in the documents the identity can view, with its blocks
+// URL: GET /v1/blocks/?duplicates=true -- only names in more than one document
+// URL: GET /v1/blocks/NAME -- the blocks named NAME
+func (l *leisure) blocksHandler(w http.ResponseWriter, r *http.Request) {
+	name := unescape(strings.TrimPrefix(r.URL.Path, BLOCKS))
+	user := identity(r)
+	duplicates := r.URL.Query().Get("duplicates") == "true"
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected GET %s or %sNAME", ErrBadCommand, BLOCKS, BLOCKS))))
+		return
+	}
+	var result any
+	var err error
+	l.sync(func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%w: %v", server.ErrInternalError, p)
+			}
+		}()
+		found := l.namedBlocks(name, user)
+		if name != "" {
+			if len(found) == 0 {
+				err = fmt.Errorf("%w: no block named %s", ErrUnknownBlock, name)
+			} else {
+				result = found[0]
+			}
+			return
+		} else if duplicates {
+			dups := []*blockName{}
+			for _, bn := range found {
+				if bn.Duplicate {
+					dups = append(dups, bn)
+				}
+			}
+			found = dups
+		}
+		result = found
+	})
+	switch server.ErrorType(err) {
+	case "":
+		writeJSON(w, result)
+	case ErrUnknownBlock.Type:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(server.ErrorJSON(err)))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+	}
+}
+
+func (cmd *BlocksListCmd) Run(cli *CLI) error {
+	if cmd.Duplicates {
+		output(cli.get(BLOCKS + "?duplicates=true"))
+	} else {
+		output(cli.get(BLOCKS))
+	}
+	return nil
+}
+
+func (cmd *BlocksFindCmd) Run(cli *CLI) error {
+	output(cli.get(BLOCKS, cmd.Name))
+	return nil
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/server"
+)
+
+const (
+	DOC_EXPORT      = server.VERSION + "/doc/export/"
+	DOC_IMPORT      = server.VERSION + "/doc/import"
+	BUNDLE_VERSION  = 1
+	BUNDLE_MANIFEST = "bundle.json"
+	BUNDLE_FILES    = "files/"
+	MAX_BUNDLE_SIZE = 1 << 30
+)
+
+var ErrBundle = server.NewLeisureError("bundleFailure")
+
+// bundleManifest describes an exported document, a gzipped tar that lays it out like the store
+//
+//	bundle.json       -- bundleManifest
+//	source.org        -- initial document text
+//	blocks.jsonl      -- history blocks, in commit order
+//	tags.json         -- named versions and their text
+//	files/HASH.json   -- fileInfo for each attachment the document links to
+//	files/HASH        -- attachment contents
+type bundleManifest struct {
+	Version  int       `json:"version"`
+	Id       string    `json:"id"`
+	Aliases  []string  `json:"aliases,omitempty"`
+	Source   string    `json:"source"` // hash of source.org
+	Latest   string    `json:"latest"` // hash of the latest text
+	Blocks   int       `json:"blocks"`
+	Files    []string  `json:"files,omitempty"`
+	Exported time.Time `json:"exported"`
+}
+
+// documentBundle is a bundle's contents in memory
+type documentBundle struct {
+	manifest bundleManifest
+	source   string
+	blocks   []*blockRecord
+	tags     map[string]*versionTag
+	files    map[string]*fileInfo
+	contents map[string][]byte
+}
+
+// exportBundle collects a document's history, aliases, and tags, called in the service goroutine.
+// The blocks are in commit order, which their nonces record, so importing can replay them.
+func (l *leisure) exportBundle(docId string) *documentBundle {
+	h := l.Documents[docId]
+	b := &documentBundle{
+		manifest: bundleManifest{
+			Version:  BUNDLE_VERSION,
+			Id:       docId,
+			Exported: time.Now().UTC(),
+		},
+		source: h.Source.GetDocument(h).String(),
+		tags:   map[string]*versionTag{},
+	}
+	for alias, id := range l.DocumentAliases {
+		if id == docId {
+			b.manifest.Aliases = append(b.manifest.Aliases, alias)
+		}
+	}
+	sort.Strings(b.manifest.Aliases)
+	for _, hash := range h.GetBlockOrder() {
+		if blk := h.GetBlock(hash); blk != nil && len(blk.Parents) > 0 {
+			rec := recordFor(blk)
+			rec.Time = blockTime(h, blk.Hash)
+			b.blocks = append(b.blocks, rec)
+		}
+	}
+	sort.Slice(b.blocks, func(i, j int) bool { return b.blocks[i].Nonce < b.blocks[j].Nonce })
+	for name, tag := range l.tags[docId] {
+		b.tags[name] = tag
+	}
+	b.manifest.Source = textHash(b.source)
+	b.manifest.Latest = textHash(h.GetLatestDocument().String())
+	b.manifest.Blocks = len(b.blocks)
+	return b
+}
+
+// attachments finds the stored attachments any version of the document links to
+func (b *documentBundle) attachments(files *fileStore) error {
+	hashes := map[string]bool{}
+	find := func(text string) {
+		for _, match := range attachmentPattern.FindAllStringSubmatch(text, -1) {
+			hashes[match[1]] = true
+		}
+	}
+	find(b.source)
+	for _, rec := range b.blocks {
+		for _, repl := range rec.Replacements {
+			find(repl.Text)
+		}
+	}
+	for _, tag := range b.tags {
+		find(tag.Text)
+	}
+	b.files = map[string]*fileInfo{}
+	b.contents = map[string][]byte{}
+	for hash := range hashes {
+		info, err := files.info(hash)
+		if server.ErrorType(err) == ErrUnknownFile.Type {
+			continue
+		} else if err != nil {
+			return err
+		}
+		contents, err := os.ReadFile(filepath.Join(files.dir, hash))
+		if err != nil {
+			return fmt.Errorf("%w: could not read file %s: %s", ErrFiles, hash, err)
+		}
+		b.files[hash] = info
+		b.contents[hash] = contents
+		b.manifest.Files = append(b.manifest.Files, hash)
+	}
+	sort.Strings(b.manifest.Files)
+	return nil
+}
+
+func (b *documentBundle) write(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	add := func(name string, contents []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(contents)), ModTime: b.manifest.Exported}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(contents)
+		return err
+	}
+	addJSON := func(name string, value any) error {
+		buf, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, buf)
+	}
+	journal := &bytes.Buffer{}
+	for _, rec := range b.blocks {
+		buf, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		journal.Write(append(buf, '\n'))
+	}
+	if err := addJSON(BUNDLE_MANIFEST, &b.manifest); err != nil {
+		return err
+	} else if err := add(STORE_SOURCE, []byte(b.source)); err != nil {
+		return err
+	} else if err := add(STORE_JOURNAL, journal.Bytes()); err != nil {
+		return err
+	} else if err := addJSON(STORE_TAGS, b.tags); err != nil {
+		return err
+	}
+	for _, hash := range b.manifest.Files {
+		if err := addJSON(BUNDLE_FILES+hash+".json", b.files[hash]); err != nil {
+			return err
+		} else if err := add(BUNDLE_FILES+hash, b.contents[hash]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// readBundle reads a bundle and verifies the hashes of its source, tags, and attachments
+func readBundle(r io.Reader) (*documentBundle, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not a document bundle: %s", ErrBundle, err)
+	}
+	b := &documentBundle{
+		tags:     map[string]*versionTag{},
+		files:    map[string]*fileInfo{},
+		contents: map[string][]byte{},
+	}
+	entries := map[string][]byte{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: bad bundle: %s", ErrBundle, err)
+		} else if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		buf, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not read %s from bundle: %s", ErrBundle, hdr.Name, err)
+		}
+		entries[hdr.Name] = buf
+	}
+	if buf, ok := entries[BUNDLE_MANIFEST]; !ok {
+		return nil, fmt.Errorf("%w: bundle has no %s", ErrBundle, BUNDLE_MANIFEST)
+	} else if err := json.Unmarshal(buf, &b.manifest); err != nil {
+		return nil, fmt.Errorf("%w: bad %s: %s", ErrBundle, BUNDLE_MANIFEST, err)
+	} else if b.manifest.Version != BUNDLE_VERSION {
+		return nil, fmt.Errorf("%w: unsupported bundle version %d", ErrBundle, b.manifest.Version)
+	} else if b.manifest.Id == "" {
+		return nil, fmt.Errorf("%w: bundle has no document id", ErrBundle)
+	}
+	b.source = string(entries[STORE_SOURCE])
+	if textHash(b.source) != b.manifest.Source {
+		return nil, fmt.Errorf("%w: %s does not match hash %s", ErrBundle, STORE_SOURCE, b.manifest.Source)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(entries[STORE_JOURNAL]))
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		rec := &blockRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return nil, fmt.Errorf("%w: bad block in %s, line %d: %s", ErrBundle, STORE_JOURNAL, line, err)
+		}
+		b.blocks = append(b.blocks, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: could not read %s: %s", ErrBundle, STORE_JOURNAL, err)
+	} else if len(b.blocks) != b.manifest.Blocks {
+		return nil, fmt.Errorf("%w: bundle has %d blocks, expected %d", ErrBundle, len(b.blocks), b.manifest.Blocks)
+	}
+	if buf, ok := entries[STORE_TAGS]; ok {
+		if err := json.Unmarshal(buf, &b.tags); err != nil {
+			return nil, fmt.Errorf("%w: bad %s: %s", ErrBundle, STORE_TAGS, err)
+		}
+	}
+	for name, tag := range b.tags {
+		if tag == nil || textHash(tag.Text) != tag.Hash {
+			return nil, fmt.Errorf("%w: text for tag %s does not match its hash", ErrBundle, name)
+		}
+		tag.Name = name
+	}
+	for _, hash := range b.manifest.Files {
+		info := &fileInfo{}
+		contents, ok := entries[BUNDLE_FILES+hash]
+		if !ok {
+			return nil, fmt.Errorf("%w: bundle is missing attachment %s", ErrBundle, hash)
+		} else if err := json.Unmarshal(entries[BUNDLE_FILES+hash+".json"], info); err != nil {
+			return nil, fmt.Errorf("%w: bad info for attachment %s: %s", ErrBundle, hash, err)
+		} else if textHash(string(contents)) != hash {
+			return nil, fmt.Errorf("%w: attachment %s does not match its hash", ErrBundle, hash)
+		}
+		b.files[hash] = info
+		b.contents[hash] = contents
+	}
+	return b, nil
+}
+
+// replay commits the bundle's blocks to a new history, verifying each block's hash
+func (b *documentBundle) replay(h *history.History) error {
+	for i, rec := range b.blocks {
+		h.Commit(rec.Peer, rec.SessionId, rec.Replacements, rec.SelectionOffset, rec.SelectionLength)
+		if blk := h.Latest[rec.SessionId]; blk == nil || hex.EncodeToString(blk.Hash[:]) != rec.Hash {
+			return fmt.Errorf("%w: block %s, number %d, did not replay", ErrBundle, rec.Hash, i+1)
+		}
+	}
+	if latest := textHash(h.GetLatestDocument().String()); latest != b.manifest.Latest {
+		return fmt.Errorf("%w: latest text %s does not match hash %s", ErrBundle, latest, b.manifest.Latest)
+	}
+	return nil
+}
+
+// importTarget is the id and aliases a bundle imports as, with the bundle's aliases unless
+// id replaces the bundle's, or an error if they are taken, called in the service goroutine
+func (l *leisure) importTarget(b *documentBundle, id string) (string, []string, error) {
+	aliases := b.manifest.Aliases
+	if id == "" || id == b.manifest.Id {
+		id = b.manifest.Id
+	} else {
+		aliases = nil
+	}
+	if l.Documents[id] != nil {
+		return "", nil, fmt.Errorf("%w: there is already a document %s", server.ErrDocumentExists, id)
+	}
+	for _, alias := range aliases {
+		if l.DocumentAliases[alias] != "" {
+			return "", nil, fmt.Errorf("%w: there is already a document with alias %s", server.ErrDocumentAliasExists, alias)
+		}
+	}
+	return id, aliases, nil
+}
+
+// importBundle adds a verified bundle's document as id, called in the service goroutine
+func (l *leisure) importBundle(b *documentBundle, id string) (*bundleManifest, error) {
+	id, aliases, err := l.importTarget(b, id)
+	if err != nil {
+		return nil, err
+	}
+	storage := l.storage(id, b.source)
+	// keep the blocks' original times
+	if times := storageTimes(storage); times != nil {
+		for _, rec := range b.blocks {
+			var hash history.Sha
+			hex.Decode(hash[:], []byte(rec.Hash))
+			if !rec.Time.IsZero() {
+				times[hash] = rec.Time
+			}
+		}
+	}
+	h := history.NewHistory(storage, b.source)
+	// the bundle already replayed in memory, so this reproduces the same blocks
+	if err := b.replay(h); err != nil {
+		if l.store != nil {
+			l.store.removeDocument(id)
+		}
+		return nil, err
+	}
+	l.registerDocument(id, h, aliases...)
+	for _, tag := range b.tags {
+		if _, err := l.addTag(id, tag); err != nil {
+			return nil, err
+		}
+	}
+	manifest := b.manifest
+	manifest.Id = id
+	manifest.Aliases = aliases
+	return &manifest, nil
+}
+
+// URL: GET /v1/doc/export/DOC -- DOC as a bundle of its history, aliases, tags, and attachments
+func (l *leisure) exportHandler(w http.ResponseWriter, r *http.Request) {
+	doc := unescape(strings.TrimPrefix(r.URL.Path, DOC_EXPORT))
+	user := identity(r)
+	var b *documentBundle
+	var err error
+	l.sync(func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%w: %v", server.ErrInternalError, p)
+			}
+		}()
+		if docId := l.docId(doc); docId == "" {
+			err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, doc)
+		} else if role := l.roleFor(docId, user); !hasRole(role, ROLE_VIEWER) {
+			err = forbidden(user, role, docId, ROLE_VIEWER)
+		} else {
+			b = l.exportBundle(docId)
+		}
+	})
+	if err == nil && l.files != nil {
+		err = b.attachments(l.files)
+	}
+	switch server.ErrorType(err) {
+	case "":
+		buf := &bytes.Buffer{}
+		if err := b.write(buf); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: could not write bundle: %s", ErrBundle, err))))
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", b.manifest.Id+".tar.gz"))
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+	case ErrForbidden.Type:
+		writeForbidden(w, err)
+	case server.ErrUnknownDocument.Type:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(server.ErrorJSON(err)))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+	}
+}
+
+// URL: POST /v1/doc/import -- body is a bundle from DOC_EXPORT, returns its bundleManifest
+// URL: POST /v1/doc/import?id=ID -- import the document as ID, without the bundle's aliases
+func (l *leisure) importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected POST %s", ErrBadCommand, DOC_IMPORT))))
+		return
+	}
+	id := r.URL.Query().Get("id")
+	b, err := readBundle(http.MaxBytesReader(w, r.Body, MAX_BUNDLE_SIZE))
+	if err == nil {
+		// verify the history before touching the peer's documents
+		err = b.replay(history.NewHistory(history.NewMemoryStorage(b.source), b.source))
+	}
+	if err == nil {
+		// check for conflicts before storing attachments
+		l.sync(func() { _, _, err = l.importTarget(b, id) })
+	}
+	var added []string // attachments this import stored, removed if it fails
+	if err == nil && len(b.files) > 0 {
+		if l.files == nil {
+			err = fmt.Errorf("%w: this peer does not store attachments", ErrFiles)
+		}
+		for _, hash := range b.manifest.Files {
+			if err != nil {
+				break
+			} else if _, infoErr := l.files.info(hash); infoErr == nil {
+				continue
+			}
+			info := b.files[hash]
+			if _, err = l.files.add(info.Name, info.Type, identity(r), bytes.NewReader(b.contents[hash])); err == nil {
+				added = append(added, hash)
+			}
+		}
+	}
+	var result *bundleManifest
+	if err == nil {
+		l.sync(func() {
+			defer func() {
+				if p := recover(); p != nil {
+					err = fmt.Errorf("%w: %v", server.ErrInternalError, p)
+				}
+			}()
+			result, err = l.importBundle(b, id)
+		})
+	}
+	if err != nil {
+		for _, hash := range added {
+			l.files.remove(hash)
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+		return
+	}
+	writeJSON(w, result)
+}
+
+func (cmd *DocExportCmd) Run(cli *CLI) error {
+	output(cli.get(DOC_EXPORT, cmd.Doc))
+	return nil
+}
+
+func (cmd *DocImportCmd) Run(cli *CLI) error {
+	path := DOC_IMPORT
+	if cmd.Id != "" {
+		path += "?id=" + url.QueryEscape(cmd.Id)
+	}
+	output(cli.request(http.MethodPost, os.Stdin, path))
+	return nil
+}
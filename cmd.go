@@ -7,14 +7,20 @@ import (
 )
 
 type GlobalOpts struct {
-	UnixSocket string `short:u help:"Path to UNIX socket -- will be created and must not exist beforehand" type:path`
-	Verbose    int    `short:v help:Verbose type:counter`
-	Cookies    string `help:"Path to cookies file" type:path`
-	Lock       bool   `help:"Lock the cookies file"`
-	ForceLock  bool   `help:"Lock the cookies file and remove other locks"`
-	Parent     int    `help:"Parent process using leisure, in case the parent is not the real owner"`
-	Host       string `help:"Host of Leisure peer"`
-	Port       int    `help:"Port of Leisure peer"`
+	UnixSocket string   `short:u help:"Path to the peer's UNIX socket -- the peer creates it, replacing a stale socket if no peer answers on it" type:path`
+	Verbose    int      `short:v help:"Verbose, -v for debug and -vv for trace messages" type:counter`
+	LogLevel   []string `help:"LEVEL (trace, debug, info, warn, error) for every subsystem or SUBSYSTEM=LEVEL for one of peer, monitor, session, cli"`
+	LogFormat  string   `help:"Log format, logfmt or json"`
+	LogFile    string   `help:"FILE for log output" type:path`
+	Cookies    string   `help:"Path to cookies file" type:path`
+	Lock       bool     `help:"Lock the cookies file"`
+	ForceLock  bool     `help:"Lock the cookies file and remove other locks"`
+	Parent     int      `help:"Parent process using leisure, in case the parent is not the real owner"`
+	Host       string   `help:"Host of Leisure peer"`
+	Port       int      `help:"Port of Leisure peer"`
+	Token      string   `help:"Token for a peer's TCP port" env:"LEISURE_TOKEN"`
+	Tls        *bool    `negatable:"" help:"Use TLS to connect to the peer's TCP port, --no-tls overrides the config file"`
+	CaCert     string   `help:"Certificate FILE to trust for TLS, such as a peer's self-signed certificate" type:path`
 	ctx        *kong.Context
 }
 
@@ -24,7 +30,13 @@ func initGlobalOpts(cli *CLI) {
 	cli.Get.GlobalOpts = opts
 	cli.Doc.GlobalOpts = opts
 	cli.Session.GlobalOpts = opts
-	cli.Peer.Monitor = "NO MONITOR"
+	cli.Link.GlobalOpts = opts
+	cli.Config.GlobalOpts = opts
+	cli.File.GlobalOpts = opts
+	cli.Comment.GlobalOpts = opts
+	cli.Search.GlobalOpts = opts
+	cli.Blocks.GlobalOpts = opts
+	cli.Peer.Monitor = NO_MONITOR
 }
 
 func (cli *CLI) defaults() {
@@ -49,23 +61,87 @@ func (cli *CLI) defaults() {
 			panic("Could not obtain home directory")
 		}
 	}
+	if cli.Peer.Bind == "" {
+		cli.Peer.Bind = "localhost"
+	}
+	if cli.Stop.Timeout == 0 {
+		cli.Stop.Timeout = 1000 * 30
+	}
 	if cli.Session.Update.Timeout == 0 {
 		cli.Session.Update.Timeout = 1000 * 60 * 2
 	}
 }
 
 type CLI struct {
-	globals GlobalOpts
-	Stop    StopCmd  `cmd help:"Stop the peer"`
-	Peer    PeerCmd  `cmd help:"Run a leisure peer on unix domain socket PATH and, optionally, on a TCP port."`
-	Parse   ParseCmd `cmd help:"Parse an org document. Example: leisure get /default.org | leisure parse"`
-	Get     GetCmd   `cmd help:"HTTP get request to leisure server"`
-	Doc     struct {
+	globals    GlobalOpts
+	Profile    string    `help:"PROFILE from the config file to use for settings that are not given as flags" env:"LEISURE_PROFILE"`
+	ConfigFile string    `name:config help:"Config FILE, defaults to $XDG_CONFIG_HOME/leisure/config.yaml or ~/.config/leisure/config.yaml" type:path env:"LEISURE_CONFIG"`
+	Stop       StopCmd   `cmd help:"Stop the peer gracefully"`
+	Peer       PeerCmd   `cmd help:"Run a leisure peer on unix domain socket PATH and, optionally, on a TCP port. Sockets passed with LISTEN_FDS are used instead."`
+	Parse      ParseCmd  `cmd help:"Parse an org document. Example: leisure get /default.org | leisure parse"`
+	Get        GetCmd    `cmd help:"HTTP get request to leisure server"`
+	Link       LinkCmd   `cmd help:"Replicate documents with another peer, or list the peers this one replicates with"`
+	Search     SearchCmd `cmd help:"Find the org chunks that contain every word in QUERY, across all documents"`
+	Doc        struct {
 		*GlobalOpts
-		List   DocListCmd   `cmd help:"List all documents"`
-		Create DocCreateCmd `cmd help:"Share a document from stdin"`
-		Get    DocGetCmd    `cmd help:"Get a document"`
+		List    DocListCmd    `cmd help:"List all documents"`
+		Create  DocCreateCmd  `cmd help:"Share a document from stdin"`
+		Get     DocGetCmd     `cmd help:"Get a document"`
+		Tag     DocTagCmd     `cmd help:"Name a version of a document, the latest one if HASH is missing"`
+		Tags    DocTagsCmd    `cmd help:"List a document's named versions"`
+		Log     DocLogCmd     `cmd help:"Show a document's history blocks, newest first"`
+		Diff    DocDiffCmd    `cmd help:"Show what changed between two versions of a document"`
+		Fork    DocForkCmd    `cmd help:"Copy a version of a document into a new document"`
+		Merge   DocMergeCmd   `cmd help:"Merge changes from SRC into DEST, where one is a fork of the other"`
+		Export  DocExportCmd  `cmd help:"Write a document's history, aliases, tags, and attachments to stdout as a bundle"`
+		Import  DocImportCmd  `cmd help:"Add a document from a bundle on stdin"`
+		Compact DocCompactCmd `cmd help:"Squash a document's old history into a snapshot, keeping tagged versions and what connected sessions need"`
+		Delete  DocDeleteCmd  `cmd help:"Delete a document with its sessions, aliases, and comment threads"`
+		Rename  DocRenameCmd  `cmd help:"Replace a document's ALIAS with NEW"`
+		Alias   struct {
+			List   DocAliasListCmd   `cmd help:"List every alias, or a document's aliases"`
+			Add    DocAliasAddCmd    `cmd help:"Give a document another alias"`
+			Remove DocAliasRemoveCmd `cmd help:"Remove one of a document's aliases"`
+		} `cmd help:"Alias commands"`
+		Members struct {
+			List   DocMembersListCmd   `cmd help:"List a document's members and their roles"`
+			Set    DocMembersSetCmd    `cmd help:"Give IDENTITY a ROLE (viewer, commenter, editor, owner) on a document"`
+			Remove DocMembersRemoveCmd `cmd help:"Remove IDENTITY from a document's members"`
+		} `cmd help:"Membership commands -- documents without members are open to everyone"`
+		Regions struct {
+			List   DocRegionsListCmd   `cmd help:"List a document's locked regions"`
+			Lock   DocRegionsLockCmd   `cmd help:"Lock a named block or a headline's subtree against edits"`
+			Unlock DocRegionsUnlockCmd `cmd help:"Unlock a region by its id, like block:NAME or headline:TEXT"`
+		} `cmd help:"Region permission commands"`
+		Markers struct {
+			List   DocMarkersListCmd   `cmd help:"List a document's markers where they are now"`
+			Get    DocMarkersGetCmd    `cmd help:"Get a marker's offset"`
+			Add    DocMarkersAddCmd    `cmd help:"Add or replace a marker at an offset in the latest document or at a chunk"`
+			Remove DocMarkersRemoveCmd `cmd help:"Remove a marker"`
+		} `cmd help:"Marker commands -- markers move with the text as the document changes"`
 	} `cmd help:"Document commands"`
+	Blocks struct {
+		*GlobalOpts
+		List BlocksListCmd `cmd help:"List the named blocks in every document, flagging names used in more than one"`
+		Find BlocksFindCmd `cmd help:"Find the blocks named NAME in every document"`
+	} `cmd help:"Named block commands -- monitor topics expect each name in only one document"`
+	Config struct {
+		*GlobalOpts
+		Show ConfigShowCmd `cmd help:"Show the settings from the selected profile merged with flags and defaults"`
+	} `cmd help:"Config file commands"`
+	Comment struct {
+		*GlobalOpts
+		Add     CommentAddCmd     `cmd help:"Comment on a range or named block of a document, or reply to a comment"`
+		List    CommentListCmd    `cmd help:"List a document's comment threads"`
+		Resolve CommentResolveCmd `cmd help:"Resolve a comment thread"`
+	} `cmd help:"Comment commands -- each comment thread is a document of its own"`
+	File struct {
+		*GlobalOpts
+		Add    FileAddCmd    `cmd help:"Store an attachment, printing its hash, url, and org link"`
+		List   FileListCmd   `cmd help:"List attachments"`
+		Get    FileGetCmd    `cmd help:"Get an attachment's contents"`
+		Delete FileDeleteCmd `cmd help:"Delete an attachment"`
+	} `cmd help:"Attachment commands"`
 	Session struct {
 		*GlobalOpts
 		List    SessionListCmd    `cmd help:"List all sessions"`
@@ -77,27 +153,238 @@ type CLI struct {
 		Edit    SessionEditCmd    `cmd help:"Add edits to a session"`
 		Refresh SessionRefreshCmd `cmd help:"Send a null edit to a sesison"`
 		Update  SessionUpdateCmd  `cmd help:"Check if a session has updates"`
+		Stream  SessionStreamCmd  `cmd help:"Print a session's updates as they happen, one JSON value per line"`
 		Unlock  SessionUnlockCmd  `cmd help:"Unlock a session"`
 		Tag     SessionTagCmd     `cmd help:"Get tagged data from a session's document"`
 	} `cmd help:"Session commands"`
 }
 
 type PeerCmd struct {
-	UnixSocket  string `short:u help:"Path to UNIX socket -- will be created and must not exist beforehand" type:path`
-	Verbose     int    `short:v help:Verbose type:counter`
-	Port        int    `short:l name:listen help:"TCP Port to listen on"`
-	Monitor     string `type:string short:m name:monitor help:"connect to REDIS [USER[:PASSWORD]@][HOST:][PORT][/DB] and monitor every document"`
-	MonitorConf string `type:string short:c name:conf help:"REDIS config file"`
-	ofs         *Overlay
-	Html        string `help:"DIRECTORY to serve files from" type:path`
-	Exclusive   bool   `short:e help:"Only one editor is expected, plus monitoring input -- no history"`
+	UnixSocket      string   `short:u help:"Path to UNIX socket -- will be created, replacing a stale socket if no peer answers on it" type:path`
+	Verbose         int      `short:v help:"Verbose, -v for debug and -vv for trace messages" type:counter`
+	LogLevel        []string `help:"LEVEL (trace, debug, info, warn, error) for every subsystem or SUBSYSTEM=LEVEL for one of peer, monitor, session, cli"`
+	LogFormat       string   `help:"Log format, logfmt or json"`
+	Port            int      `short:l name:listen help:"TCP Port to listen on"`
+	Monitor         string   `type:string short:m name:monitor help:"connect to REDIS [USER[:PASSWORD]@][HOST:][PORT][/DB] and monitor every document"`
+	MonitorConf     string   `type:string short:c name:conf help:"REDIS config file"`
+	ofs             *Overlay
+	Html            []string `help:"DIRECTORY to serve files from, later directories override earlier ones" type:path`
+	Exclusive       bool     `short:e help:"Only one editor is expected, plus monitoring input -- no history"`
+	Store           string   `help:"DIRECTORY to persist documents, aliases, and history in -- reloaded on startup" type:path`
+	Watch           string   `help:"DIRECTORY of org files to share as documents, writing merged changes back to the files" type:path`
+	Files           string   `help:"DIRECTORY for attachments served under /files/, defaults to STORE/files with --store, attachments are off without either" type:path`
+	Bind            string   `help:"ADDRESS for the TCP port, defaults to localhost -- other addresses require a token"`
+	Token           string   `help:"Require this token on every TCP request, as a bearer token or X-Leisure-Token header" env:"LEISURE_TOKEN"`
+	TlsCert         string   `name:tls-cert help:"Certificate FILE for TLS on the TCP port" type:path`
+	TlsKey          string   `name:tls-key help:"Private key FILE for TLS on the TCP port" type:path`
+	TlsGenerate     bool     `name:tls-generate help:"Generate a self-signed certificate and key if the certificate file does not exist"`
+	SocketMode      string   `help:"Octal permissions for the UNIX socket, like 0660"`
+	SocketGroup     string   `help:"GROUP name or id to own the UNIX socket"`
+	Daemon          bool     `help:"Run in the background, returning once the UNIX socket is ready"`
+	PidFile         string   `help:"FILE to write the peer's process id to" type:path`
+	LogFile         string   `help:"FILE for the peer's output, defaults to ~/.leisure.log for --daemon" type:path`
+	Replicate       []string `help:"URL of another peer's TCP port, like http://HOST:PORT, to exchange document changes with"`
+	ReplicateToken  string   `help:"Token for the peers in --replicate, their own --token lets tags carry their versions" env:"LEISURE_REPLICATE_TOKEN"`
+	ReplicateCaCert string   `help:"Certificate FILE to trust for the peers in --replicate and leisure link" type:path`
+	Users           string   `help:"YAML FILE of IDENTITY: TOKEN lines, each token acts as its identity on the TCP port, the UNIX socket uses the connecting system user" type:path`
+}
+
+type ConfigShowCmd struct{}
+
+type DocTagCmd struct {
+	Doc  string `arg help:"Document ID or alias"`
+	Name string `arg help:"NAME for the version, replacing any version with it"`
+	Hash string `arg optional help:"HASH of the version's text, defaults to the latest version"`
+}
+
+type DocTagsCmd struct {
+	Doc string `arg help:"Document ID or alias"`
+}
+
+type DocLogCmd struct {
+	Doc       string `arg help:"Document ID or alias"`
+	Format    string `short:f help:"FORMAT: text, json, or dot for Graphviz, defaults to text"`
+	Limit     int    `short:n help:"Only show the newest N blocks"`
+	Documents bool   `help:"Show the hash of each block's text, for doc tag and doc get --hash"`
+}
+
+type DocDiffCmd struct {
+	Doc    string `arg help:"Document ID or alias"`
+	From   string `arg name:hash1 help:"Tag, text hash, or block hash (from doc log) of the older version"`
+	To     string `arg optional name:hash2 help:"Tag, text hash, or block hash of the newer version, defaults to the latest version"`
+	Format string `short:f help:"FORMAT: unified, replacements, or blocks for added, removed, and changed org chunks, defaults to unified"`
+}
+
+type DocForkCmd struct {
+	Doc   string `arg help:"Document ID or alias"`
+	At    string `help:"Tag, text HASH, or block HASH (from doc log) of the version to fork, defaults to the latest version"`
+	Id    string `help:"ID for the new document, generated if missing"`
+	Alias string `help:"Alias for the new document"`
+}
+
+type DocMergeCmd struct {
+	Src  string `arg help:"Document ID or alias to merge changes from"`
+	Dest string `arg help:"Document ID or alias to merge changes into"`
+}
+
+type DocExportCmd struct {
+	Doc string `arg help:"Document ID or alias"`
+}
+
+type DocImportCmd struct {
+	Id string `help:"ID to import the document as, instead of the bundle's, leaving out its aliases"`
+}
+
+type DocDeleteCmd struct {
+	Doc string `arg help:"Document ID or alias"`
+}
+
+type DocRenameCmd struct {
+	Alias string `arg help:"ALIAS to replace"`
+	New   string `arg help:"NEW alias"`
+}
+
+type DocAliasListCmd struct {
+	Doc string `arg optional help:"Document ID or alias, lists every alias if missing"`
+}
+
+type DocAliasAddCmd struct {
+	Doc   string `arg help:"Document ID or alias"`
+	Alias string `arg help:"ALIAS to add"`
+}
+
+type DocAliasRemoveCmd struct {
+	Doc   string `arg help:"Document ID or alias"`
+	Alias string `arg help:"ALIAS to remove"`
+}
+
+type DocCompactCmd struct {
+	Doc    string `arg help:"Document ID or alias"`
+	Before string `help:"HASH of the block to compact up to (from doc log), or a DATE to compact blocks committed before"`
+}
+
+type DocMembersListCmd struct {
+	Doc string `arg help:"Document ID or alias"`
+}
+
+type DocMembersSetCmd struct {
+	Doc      string `arg help:"Document ID or alias"`
+	Identity string `arg help:"IDENTITY of the member"`
+	Role     string `arg help:"ROLE: viewer, commenter, editor, or owner"`
+}
+
+type DocMembersRemoveCmd struct {
+	Doc      string `arg help:"Document ID or alias"`
+	Identity string `arg help:"IDENTITY of the member"`
+}
+
+type DocRegionsListCmd struct {
+	Doc string `arg help:"Document ID or alias"`
+}
+
+type DocRegionsLockCmd struct {
+	Doc      string   `arg help:"Document ID or alias"`
+	Block    string   `help:"NAME of the block to lock"`
+	Headline string   `help:"TEXT of the headline whose subtree to lock"`
+	Role     string   `help:"ROLE that may still edit the region, defaults to owner -- on documents without members only the identities and sessions may"`
+	Identity []string `help:"IDENTITY that may still edit the region, whatever its role"`
+	Session  []string `help:"SESSION of a monitor on this peer that may still edit the region"`
+}
+
+type DocRegionsUnlockCmd struct {
+	Doc string `arg help:"Document ID or alias"`
+	Id  string `arg help:"ID of the region, like block:NAME or headline:TEXT"`
+}
+
+type DocMarkersListCmd struct {
+	Doc   string `arg help:"Document ID or alias"`
+	Chunk string `help:"Only list the markers on the chunk with this ID"`
+}
+
+type DocMarkersGetCmd struct {
+	Doc string `arg help:"Document ID or alias"`
+	Id  string `arg help:"ID of the marker"`
+}
+
+type DocMarkersAddCmd struct {
+	Doc    string `arg help:"Document ID or alias"`
+	Id     string `help:"ID for the marker, replacing any marker with it -- generated if missing"`
+	Offset int    `help:"OFFSET of the marker"`
+	Length int    `help:"LENGTH of text the marker covers"`
+	Chunk  string `help:"ID of an org chunk to attach the marker to instead of an offset"`
+	Data   string `help:"JSON value to keep with the marker"`
+}
+
+type DocMarkersRemoveCmd struct {
+	Doc string `arg help:"Document ID or alias"`
+	Id  string `arg help:"ID of the marker"`
+}
+
+type CommentAddCmd struct {
+	Doc    string `arg help:"Document ID or alias"`
+	Text   string `arg optional help:"TEXT of the comment, read from stdin if it is missing or -"`
+	Offset int    `help:"OFFSET of the commented range"`
+	Length int    `help:"LENGTH of the commented range"`
+	Block  string `help:"NAME of a block to comment on instead of a range"`
+	Reply  string `help:"ID of a comment to reply to"`
+}
+
+type CommentListCmd struct {
+	Doc string `arg help:"Document ID or alias"`
+	All bool   `help:"Include resolved threads"`
+}
+
+type CommentResolveCmd struct {
+	Doc string `arg help:"Document ID or alias"`
+	Id  string `arg help:"ID of the comment"`
+}
+
+type FileAddCmd struct {
+	File string `arg help:"FILE to store" type:existingfile`
+	Name string `help:"NAME for the attachment, defaults to the file's name"`
+}
+
+type FileListCmd struct{}
+
+type FileGetCmd struct {
+	Hash   string `arg help:"HASH of the attachment"`
+	Output string `short:o help:"FILE to write the contents to instead of stdout" type:path`
+}
+
+type FileDeleteCmd struct {
+	Hash string `arg help:"HASH of the attachment"`
+}
+
+type LinkCmd struct {
+	*GlobalOpts
+	Url         string `arg optional help:"URL of another peer's TCP port, like http://HOST:PORT -- lists linked peers if omitted. The peer trusts its --replicate-ca-cert for TLS."`
+	RemoteToken string `help:"Token for the other peer, its own --token lets tags carry their versions" env:"LEISURE_REPLICATE_TOKEN"`
+}
+
+type SearchCmd struct {
+	*GlobalOpts
+	Query []string `arg help:"Words to find"`
+	Limit int      `short:n help:"Show at most N results, defaults to 100"`
+}
+
+type BlocksListCmd struct {
+	Duplicates bool `short:d help:"Only list names used in more than one document"`
+}
+
+type BlocksFindCmd struct {
+	Name string `arg help:"Block NAME"`
 }
 
 type StopCmd struct {
-	UnixSocket string `short:u help:"Path to UNIX socket -- will be created and must not exist beforehand" type:path`
+	UnixSocket string `short:u help:"Path to the peer's UNIX socket -- the peer creates it, replacing a stale socket if no peer answers on it" type:path`
 	Port       int    `short:l name:listen help:"TCP Port to listen on"`
 	Host       string `help:"Host of Leisure peer"`
 	Verbose    int    `short:v help:Verbose type:counter`
+	Token      string `help:"Token for a peer's TCP port" env:"LEISURE_TOKEN"`
+	Tls        *bool  `negatable:"" help:"Use TLS to connect to the peer's TCP port, --no-tls overrides the config file"`
+	CaCert     string `help:"Certificate FILE to trust for TLS, such as a peer's self-signed certificate" type:path`
+	Wait       bool   `short:w help:"Wait for the peer to finish stopping and report the result"`
+	Timeout    int    `help:"Milliseconds to wait for the peer to stop, defaults to 30 seconds"`
 }
 
 type DocListCmd struct{}
@@ -110,6 +397,7 @@ type DocCreateCmd struct {
 type DocGetCmd struct {
 	DocId string `arg name:id help:"ID, alias, or hash of document"`
 	Hash  string `help:"ID is a document hash"`
+	Tag   string `help:"Get the version of the document named TAG"`
 	Dump  bool   `help:"Request a dump of an org document instead of the document itself"`
 	Org   bool   `help:"Request document in org format"`
 	Data  bool   `help:"Request document data"`
@@ -153,6 +441,12 @@ type SessionUpdateCmd struct {
 	Timeout int `help:"Timeout in milliseconds, defaults to 2 minutes"`
 }
 
+type SessionStreamCmd struct {
+	Notify          bool `help:"Print true for each update instead of committing it, for clients that send their own edits"`
+	SelectionOffset int  `help:"Offset of the client's selection, transformed by each update"`
+	SelectionLength int  `help:"Length of the client's selection"`
+}
+
 type SessionUnlockCmd struct{}
 
 type SessionTagCmd struct {
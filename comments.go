@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leisure-tools/org"
+	"github.com/leisure-tools/server"
+)
+
+const (
+	COMMENTS        = server.VERSION + "/comments/"
+	COMMENT_PREFIX  = "COMMENT-"
+	REPLY_PREFIX    = "REPLIES-"
+	COMMENT_RESOLVE = "resolve"
+)
+
+var ErrComment = server.NewLeisureError("commentFailure")
+var ErrUnknownComment = server.NewLeisureError("unknownComment")
+
+var COMMENT_ENTRY_RE = regexp.MustCompile(`^\* (\S+) (\S+)\s*$`)
+
+// comment is a thread anchored to a named block or a marker's range in a target document.
+// The thread's entries are the text of the comment's own document:
+//
+//	#+title: Comment on TARGET
+//	#+begin_quote
+//	anchored text
+//	#+end_quote
+//	* AUTHOR TIME
+//	text
+type comment struct {
+	Id         string    `json:"id"`
+	Target     string    `json:"target"`
+	Block      string    `json:"block,omitempty"`
+	Marker     string    `json:"marker,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	Created    time.Time `json:"created"`
+	Resolved   bool      `json:"resolved,omitempty"`
+	ResolvedBy string    `json:"resolvedBy,omitempty"`
+}
+
+// documentComments maps comment documents to their comments
+type documentComments map[string]*comment
+
+type commentEntry struct {
+	Author  string `json:"author"`
+	Created string `json:"created"`
+	Text    string `json:"text"`
+}
+
+type commentThread struct {
+	*comment
+	Offset  int            `json:"offset"`
+	Length  int            `json:"length"`
+	Quote   string         `json:"quote"`
+	Entries []commentEntry `json:"entries"`
+}
+
+// appendText adds text to the end of a document with a session of its own
+func (l *leisure) appendText(docId, sessionId, text string) error {
+	s := l.Sessions[sessionId]
+	if s == nil {
+		var err error
+		if s, err = l.AddSession(sessionId, l.Documents[docId], false, true, false, 0); err != nil {
+			return err
+		}
+	}
+	if _, _, _, err := s.Commit(0, 0, &org.ChunkChanges{}); err != nil {
+		return err
+	}
+	current := s.LatestBlock().GetDocument(s.History).String()
+	if current != "" && !strings.HasSuffix(current, "\n") {
+		text = "\n" + text
+	}
+	s.Replace(len(current), 0, text)
+	_, _, _, err := s.Commit(0, 0, &org.ChunkChanges{})
+	return err
+}
+
+func entryText(author, text string) string {
+	if author == "" {
+		author = "anonymous"
+	}
+	return fmt.Sprintf("* %s %s\n%s\n", strings.ReplaceAll(author, " ", "_"), time.Now().UTC().Format(time.RFC3339), strings.TrimRight(text, "\n"))
+}
+
+func parseEntries(text string) []commentEntry {
+	entries := []commentEntry{}
+	var body []string
+	for _, line := range strings.Split(text, "\n") {
+		if m := COMMENT_ENTRY_RE.FindStringSubmatch(line); m != nil {
+			if len(entries) > 0 {
+				entries[len(entries)-1].Text = strings.TrimSpace(strings.Join(body, "\n"))
+			}
+			entries = append(entries, commentEntry{Author: m[1], Created: m[2]})
+			body = body[:0]
+		} else {
+			body = append(body, line)
+		}
+	}
+	if len(entries) > 0 {
+		entries[len(entries)-1].Text = strings.TrimSpace(strings.Join(body, "\n"))
+	}
+	return entries
+}
+
+// thread returns a comment with its anchor and entries as they are now, called in the service goroutine
+func (l *leisure) thread(c *comment) *commentThread {
+	t := &commentThread{comment: c, Entries: []commentEntry{}}
+	if h := l.Documents[c.Target]; h != nil {
+		text := h.GetLatestDocument().String()
+		if c.Block != "" {
+			if offset, ref := org.Parse(text).LocateChunkNamed(c.Block); !ref.IsEmpty() {
+				t.Offset, t.Length = offset, len(ref.AsOrgChunk().Text)
+			}
+		} else if m := l.markers[c.Target][c.Marker]; m != nil {
+			t.Offset, t.Length = m.Offset, m.Length
+		}
+		if t.Offset+t.Length <= len(text) {
+			t.Quote = text[t.Offset : t.Offset+t.Length]
+		}
+	}
+	if h := l.Documents[c.Id]; h != nil {
+		t.Entries = parseEntries(h.GetLatestDocument().String())
+	}
+	return t
+}
+
+// addComment starts a thread on a target document, called in the service goroutine
+func (l *leisure) addComment(target, author, text, block string, offset, length int) (*comment, error) {
+	key := make([]byte, 8)
+	rand.Read(key)
+	c := &comment{
+		Id:      COMMENT_PREFIX + hex.EncodeToString(key),
+		Target:  target,
+		Block:   block,
+		Author:  author,
+		Created: time.Now().UTC(),
+	}
+	current := l.Documents[target].GetLatestDocument().String()
+	quote := ""
+	if block != "" {
+		if _, ref := org.Parse(current).LocateChunkNamed(block); ref.IsEmpty() {
+			return nil, fmt.Errorf("%w: no block named %s in document %s", ErrComment, block, target)
+		}
+	} else if m, err := l.addMarker(target, &marker{Id: c.Id, Offset: offset, Length: length}); err != nil {
+		return nil, err
+	} else {
+		c.Marker = m.Id
+		quote = current[offset : offset+length]
+	}
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "#+title: Comment on %s\n", target)
+	if quote != "" {
+		fmt.Fprintf(sb, "#+begin_quote\n%s\n#+end_quote\n", strings.TrimRight(quote, "\n"))
+	}
+	sb.WriteString(entryText(author, text))
+	l.addDocument(c.Id, "", sb.String())
+	l.comments[c.Id] = c
+	if l.store != nil {
+		l.store.saveMeta()
+	}
+	return c, nil
+}
+
+// commentRole lets whoever can view a comment's target view its document. Threads only
+// change through COMMENTS, so sessions on comment documents are read-only for everyone.
+func (l *leisure) commentRole(docId, user string) (string, bool) {
+	if c := l.comments[docId]; c != nil {
+		if role := l.roleFor(c.Target, user); !hasRole(role, ROLE_VIEWER) {
+			return role, true
+		}
+		return ROLE_VIEWER, true
+	}
+	return "", false
+}
+
+// URL: GET /v1/comments/DOC -- DOC's unresolved threads, ?all=true includes resolved ones
+// URL: POST /v1/comments/DOC -- body {"text": TEXT, "offset": N, "length": N} or {"text": TEXT, "block": NAME}
+// URL: POST /v1/comments/DOC/COMMENT -- body {"text": TEXT}, reply to a thread
+// URL: POST /v1/comments/DOC/COMMENT/resolve -- the comment's author or the document's editors
+func (l *leisure) commentsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, COMMENTS), "/")
+	for i, part := range parts {
+		parts[i] = unescape(part)
+	}
+	doc, id, action := parts[0], "", ""
+	if len(parts) > 1 {
+		id = parts[1]
+	}
+	if len(parts) > 2 {
+		action = parts[2]
+	}
+	user := identity(r)
+	var body struct {
+		Text   string `json:"text"`
+		Block  string `json:"block"`
+		Offset int    `json:"offset"`
+		Length int    `json:"length"`
+	}
+	if r.Method == http.MethodPost && action == "" {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Text) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected {\"text\": TEXT} with an offset and length or a block", ErrBadCommand))))
+			return
+		}
+	} else if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: unsupported method %s", ErrBadCommand, r.Method))))
+		return
+	}
+	var result any
+	var err error
+	l.sync(func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%w: %v", ErrComment, p)
+			}
+		}()
+		docId := l.docId(doc)
+		if docId == "" {
+			err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, doc)
+			return
+		}
+		needed := ROLE_VIEWER
+		if r.Method == http.MethodPost {
+			needed = ROLE_COMMENTER
+		}
+		role := l.roleFor(docId, user)
+		if !hasRole(role, needed) {
+			err = forbidden(user, role, docId, needed)
+			return
+		}
+		var c *comment
+		if id != "" {
+			if c = l.comments[id]; c == nil || c.Target != docId {
+				err = fmt.Errorf("%w: no comment %s on document %s", ErrUnknownComment, id, docId)
+				return
+			}
+		}
+		if err = l.followMarkers(docId); err != nil {
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && c != nil:
+			result = l.thread(c)
+		case r.Method == http.MethodGet:
+			all := r.URL.Query().Get("all") == "true"
+			threads := []*commentThread{}
+			for _, c := range l.comments {
+				if c.Target == docId && (all || !c.Resolved) {
+					threads = append(threads, l.thread(c))
+				}
+			}
+			sort.Slice(threads, func(i, j int) bool { return threads[i].Created.Before(threads[j].Created) })
+			result = threads
+		case action == COMMENT_RESOLVE && c != nil:
+			if c.Author != user && !hasRole(role, ROLE_EDITOR) {
+				err = forbidden(user, role, docId, ROLE_EDITOR)
+				return
+			}
+			c.Resolved, c.ResolvedBy = true, user
+			if l.store != nil {
+				l.store.saveMeta()
+			}
+			result = l.thread(c)
+		case action != "":
+			err = fmt.Errorf("%w: unknown comment action %s", ErrBadCommand, action)
+		case c != nil:
+			if err = l.appendText(c.Id, REPLY_PREFIX+c.Id, entryText(user, body.Text)); err == nil {
+				result = l.thread(c)
+			}
+		default:
+			if c, err = l.addComment(docId, user, body.Text, body.Block, body.Offset, body.Length); err == nil {
+				result = l.thread(c)
+			}
+		}
+	})
+	switch server.ErrorType(err) {
+	case "":
+		writeJSON(w, result)
+	case ErrForbidden.Type:
+		writeForbidden(w, err)
+	case ErrUnknownComment.Type:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(server.ErrorJSON(err)))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+	}
+}
+
+func (cmd *CommentAddCmd) Run(cli *CLI) error {
+	text := cmd.Text
+	if text == "" || text == "-" {
+		buf, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			panicWith("%w: could not read comment: %s", ErrComment, err)
+		}
+		text = string(buf)
+	}
+	body := map[string]any{"text": text}
+	if cmd.Reply == "" && cmd.Block != "" {
+		body["block"] = cmd.Block
+	} else if cmd.Reply == "" {
+		body["offset"] = cmd.Offset
+		body["length"] = cmd.Length
+	}
+	buf, _ := json.Marshal(body)
+	if cmd.Reply != "" {
+		output(cli.request(http.MethodPost, bytes.NewReader(buf), COMMENTS, cmd.Doc, cmd.Reply))
+	} else {
+		output(cli.request(http.MethodPost, bytes.NewReader(buf), COMMENTS, cmd.Doc))
+	}
+	return nil
+}
+
+func (cmd *CommentListCmd) Run(cli *CLI) error {
+	path := COMMENTS + url.PathEscape(cmd.Doc)
+	if cmd.All {
+		path += "?all=true"
+	}
+	output(cli.get(path))
+	return nil
+}
+
+func (cmd *CommentResolveCmd) Run(cli *CLI) error {
+	output(cli.request(http.MethodPost, nil, COMMENTS, cmd.Doc, cmd.Id, COMMENT_RESOLVE))
+	return nil
+}
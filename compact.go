@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/server"
+)
+
+const DOC_COMPACT = server.VERSION + "/doc/compact/"
+
+var ErrCompact = server.NewLeisureError("compactFailure")
+
+// date formats for doc compact --before
+var CUTOFF_FORMATS = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// compaction describes a compacted document
+type compaction struct {
+	Document string `json:"document"`
+	Cutoff   string `json:"cutoff"`   // the block the snapshot was taken at
+	Snapshot string `json:"snapshot"` // hash of the snapshot's text
+	Before   int    `json:"before"`   // blocks before compacting
+	After    int    `json:"after"`
+}
+
+// ancestors is a block and every block before it
+func ancestors(h *history.History, blk *history.OpBlock) map[history.Sha]bool {
+	result := map[history.Sha]bool{}
+	todo := []*history.OpBlock{blk}
+	for len(todo) > 0 {
+		blk, todo = todo[len(todo)-1], todo[:len(todo)-1]
+		if blk == nil || result[blk.Hash] {
+			continue
+		}
+		result[blk.Hash] = true
+		for _, parent := range blk.Parents {
+			todo = append(todo, h.GetBlock(parent))
+		}
+	}
+	return result
+}
+
+// findCutoff finds the block a document should be compacted at, the newest one committed
+// before a date or the one with a hash or unique hash prefix, called in the service goroutine
+func (l *leisure) findCutoff(docId, before string) (*history.OpBlock, error) {
+	h := l.Documents[docId]
+	order := h.GetBlockOrder()
+	for _, format := range CUTOFF_FORMATS {
+		date, err := time.ParseInLocation(format, before, time.Local)
+		if err != nil {
+			continue
+		}
+		var cutoff *history.OpBlock
+		for _, hash := range order {
+			if t := blockTime(h, hash); !t.IsZero() && t.Before(date) {
+				if blk := h.GetBlock(hash); cutoff == nil || blk.Nonce > cutoff.Nonce {
+					cutoff = blk
+				}
+			}
+		}
+		if cutoff == nil {
+			return nil, fmt.Errorf("%w: no blocks in %s before %s", ErrCompact, docId, before)
+		}
+		return cutoff, nil
+	}
+	var cutoff *history.OpBlock
+	for _, hash := range order {
+		if strings.HasPrefix(hex.EncodeToString(hash[:]), strings.ToLower(before)) {
+			if cutoff != nil {
+				return nil, fmt.Errorf("%w: more than one block in %s starts with %s", ErrCompact, docId, before)
+			}
+			cutoff = h.GetBlock(hash)
+		}
+	}
+	if cutoff == nil || before == "" {
+		return nil, fmt.Errorf("%w: no block %s in %s, expected a block hash or a date", ErrCompact, before, docId)
+	}
+	return cutoff, nil
+}
+
+// compactDocument squashes the history up to a block into a snapshot and replays the rest
+// on it, called in the service goroutine.
+//
+// The snapshot moves back until it is in the history of every session on the document,
+// so each one still has the block it will commit against, and tagged versions keep
+// their text. Blocks whose session last committed before the snapshot have their
+// replacements moved past the changes between that commit and the snapshot. The
+// document is only replaced if the compacted history ends with the same text and
+// the same view for every session.
+func (l *leisure) compactDocument(docId, before string) (*compaction, error) {
+	h := l.Documents[docId]
+	requested, err := l.findCutoff(docId, before)
+	if err != nil {
+		return nil, err
+	}
+	order := h.GetBlockOrder()
+	result := &compaction{Document: docId, Before: len(order)}
+	sessions := []*server.LeisureSession{}
+	candidates := ancestors(h, requested)
+	for _, s := range l.Sessions {
+		if s.History != h {
+			continue
+		}
+		sessions = append(sessions, s)
+		held := ancestors(h, h.Latest[s.SessionId])
+		for hash := range candidates {
+			if !held[hash] {
+				delete(candidates, hash)
+			}
+		}
+	}
+	cutoff := h.Source
+	for _, hash := range order {
+		if candidates[hash] {
+			cutoff = h.GetBlock(hash)
+		}
+	}
+	result.Cutoff = hex.EncodeToString(cutoff.Hash[:])
+	if cutoff == h.Source {
+		result.After = result.Before
+		return result, nil
+	}
+	squashed := ancestors(h, cutoff)
+	kept := make([]*history.OpBlock, 0, len(order)-len(squashed))
+	for _, hash := range order {
+		if !squashed[hash] {
+			kept = append(kept, h.GetBlock(hash))
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Nonce < kept[j].Nonce })
+	snapshot := cutoff.GetDocument(h).String()
+	var storage history.DocStorage
+	var fst *fileStorage
+	if l.store != nil {
+		fst = l.store.compactStorage(docId, snapshot)
+		storage = fst
+	} else {
+		storage = newTimedStorage(snapshot)
+	}
+	times := storageTimes(storage)
+	compacted := history.NewHistory(storage, snapshot)
+	viewText := func(h *history.History, sessionId string) string {
+		if blk := h.Latest[sessionId]; blk != nil {
+			return blk.GetDocument(h).String()
+		}
+		return h.Source.GetDocument(h).String()
+	}
+	for _, blk := range kept {
+		prev := blk.SessionParent(h).GetDocument(h).String()
+		current := viewText(compacted, blk.SessionId)
+		repls, selOff := blk.Replacements, blk.SelectionOffset
+		if prev != current {
+			moved := lineReplacements(diffLines(splitLines(prev), splitLines(current)))
+			repls = make([]history.Replacement, 0, len(blk.Replacements))
+			for _, repl := range blk.Replacements {
+				start := mapOffset(repl.Offset, moved, false)
+				end := max(start, mapOffset(repl.Offset+repl.Length, moved, false))
+				repls = append(repls, history.Replacement{Offset: start, Length: end - start, Text: repl.Text})
+			}
+			if selOff >= 0 {
+				selOff = mapOffset(selOff, moved, false)
+			}
+		}
+		last := compacted.Latest[blk.SessionId]
+		compacted.Commit(blk.Peer, blk.SessionId, repls, selOff, blk.SelectionLength)
+		if after := compacted.Latest[blk.SessionId]; after != nil && after != last {
+			times[after.Hash] = blockTime(h, blk.Hash)
+		}
+	}
+	if compacted.GetLatestDocument().String() != h.GetLatestDocument().String() {
+		return nil, fmt.Errorf("%w: replaying %s after %s changed its text, try another cutoff", ErrCompact, docId, shortHash(result.Cutoff))
+	}
+	for _, s := range sessions {
+		if viewText(compacted, s.SessionId) != viewText(h, s.SessionId) {
+			return nil, fmt.Errorf("%w: replaying %s after %s changed session %s's view, try another cutoff", ErrCompact, docId, shortHash(result.Cutoff), s.SessionId)
+		}
+	}
+	for _, tag := range l.tags[docId] {
+		storage.StoreDocument(tag.Text)
+	}
+	if info := l.forks[docId]; info != nil && info.Text == "" {
+		// merges need the version the fork started at
+		info.Text = h.Source.GetDocument(h).String()
+	}
+	if fst != nil {
+		// the fork's text has to be saved before its source goes away
+		l.store.saveMeta()
+		if err := l.store.finishCompact(docId, fst, compacted); err != nil {
+			return nil, err
+		}
+	}
+	l.Documents[docId] = compacted
+	for _, s := range sessions {
+		s.History = compacted
+	}
+	result.Snapshot = textHash(snapshot)
+	result.After = len(compacted.GetBlockOrder())
+	return result, nil
+}
+
+// URL: POST /v1/doc/compact/DOC?before=HASH|DATE -- squash DOC's history up to a block, or the
+// last block before a date, into a snapshot, returns the compaction
+func (l *leisure) compactHandler(w http.ResponseWriter, r *http.Request) {
+	doc := unescape(strings.TrimPrefix(r.URL.Path, DOC_COMPACT))
+	user := identity(r)
+	before := r.URL.Query().Get("before")
+	if r.Method != http.MethodPost || doc == "" || before == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected POST %sDOC?before=HASH|DATE", ErrBadCommand, DOC_COMPACT))))
+		return
+	}
+	var result *compaction
+	var err error
+	l.sync(func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%w: %v", ErrCompact, p)
+			}
+		}()
+		if docId := l.docId(doc); docId == "" {
+			err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, doc)
+		} else if role := l.roleFor(docId, user); !hasRole(role, ROLE_OWNER) {
+			err = forbidden(user, role, docId, ROLE_OWNER)
+		} else {
+			result, err = l.compactDocument(docId, before)
+		}
+	})
+	switch server.ErrorType(err) {
+	case "":
+		writeJSON(w, result)
+	case ErrForbidden.Type:
+		writeForbidden(w, err)
+	case server.ErrUnknownDocument.Type:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(server.ErrorJSON(err)))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+	}
+}
+
+func (cmd *DocCompactCmd) Run(cli *CLI) error {
+	output(cli.request(http.MethodPost, nil, DOC_COMPACT+url.PathEscape(cmd.Doc)+"?before="+url.QueryEscape(cmd.Before)))
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/leisure-tools/server"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	CONFIG_DIR      = "leisure"
+	CONFIG_FILE     = "config.yaml"
+	DEFAULT_PROFILE = "default"
+	NO_MONITOR      = "NO MONITOR"
+)
+
+var ErrConfig = server.NewLeisureError("configFailure")
+
+// leisureConfig is the YAML config file, $XDG_CONFIG_HOME/leisure/config.yaml or
+// ~/.config/leisure/config.yaml by default
+//
+//	profile: work        # used when there is no --profile
+//	profiles:
+//	  default:
+//	    port: 8080
+//	  work:
+//	    socket: ~/.leisure-work.socket
+//	    monitor: localhost:6379
+//	    html: [~/leisure/html]
+type leisureConfig struct {
+	Profile  string                    `yaml:"profile,omitempty"`
+	Profiles map[string]*configProfile `yaml:"profiles"`
+}
+
+// configProfile holds settings for the peer and the CLI, flags take precedence
+type configProfile struct {
+	Socket      string   `yaml:"socket,omitempty"`
+	Host        string   `yaml:"host,omitempty"`
+	Port        int      `yaml:"port,omitempty"`
+	Bind        string   `yaml:"bind,omitempty"`
+	Token       string   `yaml:"token,omitempty"`
+	Tls         bool     `yaml:"tls,omitempty"`
+	CaCert      string   `yaml:"ca-cert,omitempty"`
+	Monitor     string   `yaml:"monitor,omitempty"`
+	MonitorConf string   `yaml:"monitor-conf,omitempty"`
+	Html        []string `yaml:"html,omitempty"`
+	Store       string   `yaml:"store,omitempty"`
+	Verbose     int      `yaml:"verbose,omitempty"`
+	LogLevel    []string `yaml:"log-level,omitempty"`
+	LogFormat   string   `yaml:"log-format,omitempty"`
+	Users       string   `yaml:"users,omitempty"`
+}
+
+// configFile is --config or the config file in $XDG_CONFIG_HOME, or in ~/.config without it
+func (cli *CLI) configFile() string {
+	if cli.ConfigFile != "" {
+		return cli.ConfigFile
+	} else if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, CONFIG_DIR, CONFIG_FILE)
+	} else if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".config", CONFIG_DIR, CONFIG_FILE)
+	}
+	return ""
+}
+
+// readConfig returns the selected profile, which is empty if there is no config file
+func (cli *CLI) readConfig() (string, *configProfile, error) {
+	name := cli.configFile()
+	config := &leisureConfig{}
+	if name != "" {
+		if buf, err := os.ReadFile(name); err == nil {
+			if err := yaml.UnmarshalStrict(buf, config); err != nil {
+				return "", nil, fmt.Errorf("%w: bad config file %s: %s", ErrConfig, name, err)
+			}
+		} else if !os.IsNotExist(err) || cli.ConfigFile != "" {
+			return "", nil, fmt.Errorf("%w: could not read config file %s: %s", ErrConfig, name, err)
+		}
+	}
+	profile := cli.Profile
+	if profile == "" {
+		profile = config.Profile
+	}
+	if profile == "" {
+		profile = DEFAULT_PROFILE
+	}
+	if p := config.Profiles[profile]; p != nil {
+		return profile, p.expand(), nil
+	} else if profile != DEFAULT_PROFILE {
+		names := make([]string, 0, len(config.Profiles))
+		for name := range config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", nil, fmt.Errorf("%w: no profile %s in %s, profiles are %v", ErrConfig, profile, name, names)
+	}
+	return profile, &configProfile{}, nil
+}
+
+// expand ~ in paths
+func (p *configProfile) expand() *configProfile {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	expand := func(path string) string {
+		if path == "~" || (len(path) > 1 && path[:2] == "~/") {
+			return filepath.Join(home, path[1:])
+		}
+		return path
+	}
+	p.Socket = expand(p.Socket)
+	p.CaCert = expand(p.CaCert)
+	p.MonitorConf = expand(p.MonitorConf)
+	p.Store = expand(p.Store)
+	p.Users = expand(p.Users)
+	for i, dir := range p.Html {
+		p.Html[i] = expand(dir)
+	}
+	return p
+}
+
+// setDefault sets a field that was not given as a flag, boolean flags are pointers so
+// that --no-FLAG can turn off a profile's true
+func setDefault[T comparable](field *T, value T) {
+	var zero T
+	if *field == zero {
+		*field = value
+	}
+}
+
+// isTrue reports whether a boolean flag or its profile default is set to true
+func isTrue(flag *bool) bool {
+	return flag != nil && *flag
+}
+
+// applyConfig fills in options that were not given as flags from the selected profile
+func (cli *CLI) applyConfig() {
+	_, p, err := cli.readConfig()
+	if err != nil {
+		panicWith("%w", err)
+	}
+	opts := &cli.globals
+	setDefault(&opts.UnixSocket, p.Socket)
+	setDefault(&opts.Host, p.Host)
+	setDefault(&opts.Port, p.Port)
+	setDefault(&opts.Token, p.Token)
+	setDefault(&opts.Tls, &p.Tls)
+	setDefault(&opts.CaCert, p.CaCert)
+	setDefault(&opts.Verbose, p.Verbose)
+	setDefault(&opts.LogFormat, p.LogFormat)
+	if len(opts.LogLevel) == 0 {
+		opts.LogLevel = p.LogLevel
+	}
+	peer := &cli.Peer
+	setDefault(&peer.UnixSocket, p.Socket)
+	setDefault(&peer.Port, p.Port)
+	setDefault(&peer.Bind, p.Bind)
+	setDefault(&peer.Token, p.Token)
+	setDefault(&peer.MonitorConf, p.MonitorConf)
+	setDefault(&peer.Store, p.Store)
+	setDefault(&peer.Verbose, p.Verbose)
+	setDefault(&peer.LogFormat, p.LogFormat)
+	setDefault(&peer.Users, p.Users)
+	if peer.Monitor == NO_MONITOR && p.Monitor != "" {
+		peer.Monitor = p.Monitor
+	}
+	if len(peer.LogLevel) == 0 {
+		peer.LogLevel = p.LogLevel
+	}
+	if len(peer.Html) == 0 {
+		peer.Html = p.Html
+	}
+	stop := &cli.Stop
+	setDefault(&stop.UnixSocket, p.Socket)
+	setDefault(&stop.Host, p.Host)
+	setDefault(&stop.Port, p.Port)
+	setDefault(&stop.Token, p.Token)
+	setDefault(&stop.Tls, &p.Tls)
+	setDefault(&stop.CaCert, p.CaCert)
+	setDefault(&stop.Verbose, p.Verbose)
+}
+
+// print the selected profile merged with flags and defaults
+func (cmd *ConfigShowCmd) Run(cli *CLI) error {
+	profile, p, err := cli.readConfig()
+	if err != nil {
+		panicWith("%w", err)
+	}
+	opts := &cli.globals
+	merged := &configProfile{
+		Socket:      opts.UnixSocket,
+		Host:        opts.Host,
+		Port:        opts.Port,
+		Bind:        p.Bind,
+		Token:       opts.Token,
+		Tls:         isTrue(opts.Tls),
+		CaCert:      opts.CaCert,
+		Monitor:     p.Monitor,
+		MonitorConf: p.MonitorConf,
+		Html:        p.Html,
+		Store:       p.Store,
+		Verbose:     opts.Verbose,
+		LogLevel:    opts.LogLevel,
+		LogFormat:   opts.LogFormat,
+		Users:       p.Users,
+	}
+	setDefault(&merged.Bind, "localhost")
+	if merged.Token != "" {
+		merged.Token = "********"
+	}
+	buf, err := yaml.Marshal(&leisureConfig{
+		Profile:  profile,
+		Profiles: map[string]*configProfile{profile: merged},
+	})
+	if err != nil {
+		panic(err)
+	}
+	file := cli.configFile()
+	if file == "" {
+		file = "none, neither $XDG_CONFIG_HOME nor $HOME is set"
+	} else if _, err := os.Stat(file); err != nil {
+		file += " (missing)"
+	}
+	fmt.Printf("# config file: %s\n%s", file, buf)
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/leisure-tools/server"
+)
+
+const (
+	LISTEN_FDS_START = 3 // first inherited descriptor, as in sd_listen_fds(3)
+	DAEMON_ENV       = "LEISURE_DAEMON"
+	DAEMON_READY_ENV = "LEISURE_READY_FD" // the daemon child's end of the readiness pipe
+	DAEMON_READY_FD  = 3                  // the first of exec.Cmd's ExtraFiles
+	DAEMON_READY     = 10 * time.Second
+	DEFAULT_LOG_FILE = ".leisure.log"
+)
+
+var ErrDaemon = server.NewLeisureError("daemonFailure")
+
+// inheritedListeners returns the UNIX and TCP listeners passed with LISTEN_FDS and LISTEN_PID,
+// if there are any. The variables are cleared so children do not inherit them.
+func inheritedListeners() (unix *net.UnixListener, tcp net.Listener, err error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, perr := strconv.Atoi(os.Getenv("LISTEN_PID")); perr != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	count, cerr := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if cerr != nil || count <= 0 {
+		return nil, nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count; i++ {
+		fd := LISTEN_FDS_START + i
+		name := fmt.Sprint("LISTEN_FD_", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), name)
+		listener, lerr := net.FileListener(file)
+		file.Close()
+		if lerr != nil {
+			return nil, nil, fmt.Errorf("%w: inherited descriptor %d (%s) is not a listening socket: %s", ErrSocketFailure, fd, name, lerr)
+		}
+		switch l := listener.(type) {
+		case *net.UnixListener:
+			if unix != nil {
+				return nil, nil, fmt.Errorf("%w: more than one inherited UNIX socket", ErrSocketFailure)
+			}
+			// the socket belongs to whoever passed it in
+			l.SetUnlinkOnClose(false)
+			unix = l
+		case *net.TCPListener:
+			if tcp != nil {
+				return nil, nil, fmt.Errorf("%w: more than one inherited TCP socket", ErrSocketFailure)
+			}
+			tcp = l
+		default:
+			listener.Close()
+			return nil, nil, fmt.Errorf("%w: unsupported inherited socket %s", ErrSocketFailure, listener.Addr())
+		}
+	}
+	return unix, tcp, nil
+}
+
+// notifyReady tells the parent of a daemon or a service manager that asked with NOTIFY_SOCKET
+// that the peer is serving
+func notifyReady() {
+	if fd, err := strconv.Atoi(os.Getenv(DAEMON_READY_ENV)); err == nil {
+		os.Unsetenv(DAEMON_READY_ENV)
+		ready := os.NewFile(uintptr(fd), "ready")
+		ready.Write([]byte("READY=1\n"))
+		ready.Close()
+	}
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+	if strings.HasPrefix(name, "@") {
+		// abstract socket
+		name = "\x00" + name[1:]
+	}
+	if conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"}); err == nil {
+		conn.Write([]byte("READY=1"))
+		conn.Close()
+	}
+}
+
+func isDaemonChild() bool {
+	return os.Getenv(DAEMON_ENV) == "child"
+}
+
+// daemonize starts this command again in a new session with its output in the log file,
+// waits until the child says it is serving on a pipe, and reports the child's pid.
+// Waiting on the child rather than its socket keeps another peer on the socket from
+// passing for it.
+func (cmd *PeerCmd) daemonize() {
+	logName := cmd.logFile()
+	logFile, err := os.OpenFile(logName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		panicWith("%w: could not open log file %s: %s", ErrDaemon, logName, err)
+	}
+	defer logFile.Close()
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		panicWith("%w: could not open %s: %s", ErrDaemon, os.DevNull, err)
+	}
+	defer devNull.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		panicWith("%w: could not find the leisure executable: %s", ErrDaemon, err)
+	}
+	readyIn, readyOut, err := os.Pipe()
+	if err != nil {
+		panicWith("%w: could not make a pipe: %s", ErrDaemon, err)
+	}
+	defer readyIn.Close()
+	child := exec.Command(exe, os.Args[1:]...)
+	child.Env = append(os.Environ(), DAEMON_ENV+"=child", fmt.Sprint(DAEMON_READY_ENV, "=", DAEMON_READY_FD))
+	child.Stdin = devNull
+	child.Stdout = logFile
+	child.Stderr = logFile
+	child.ExtraFiles = []*os.File{readyOut}
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = child.Start()
+	// only the child holds the pipe open now, so it closes when the child exits
+	readyOut.Close()
+	if err != nil {
+		panicWith("%w: could not start peer: %s", ErrDaemon, err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- child.Wait() }()
+	ready := make(chan bool, 1)
+	go func() {
+		line, _ := bufio.NewReader(readyIn).ReadString('\n')
+		if strings.TrimSpace(line) == "READY=1" {
+			ready <- true
+		}
+	}()
+	select {
+	case err := <-exited:
+		panicWith("%w: peer exited during startup (%v), see %s", ErrDaemon, err, logName)
+	case <-time.After(DAEMON_READY):
+		panicWith("%w: peer did not open %s in time, see %s", ErrDaemon, cmd.UnixSocket, logName)
+	case <-ready:
+		fmt.Printf(`{"pid":%d,"socket":%q,"log":%q}`+"\n", child.Process.Pid, cmd.UnixSocket, logName)
+		child.Process.Release()
+	}
+}
+
+func (cmd *PeerCmd) logFile() string {
+	if cmd.LogFile != "" {
+		return cmd.LogFile
+	} else if dir, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(dir, DEFAULT_LOG_FILE)
+	}
+	panic("Could not obtain home directory")
+}
+
+func (cmd *PeerCmd) writePidFile() {
+	if cmd.PidFile == "" {
+		return
+	}
+	if err := os.WriteFile(cmd.PidFile, []byte(fmt.Sprintln(os.Getpid())), 0644); err != nil {
+		panicWith("%w: could not write pid file %s: %s", ErrDaemon, cmd.PidFile, err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const TEST_LISTEN_ENV = "LEISURE_TEST_LISTEN"
+
+// TestInheritedListeners passes a UNIX and a TCP listener to a child test process the way a
+// service manager would and checks that the child serves on both
+func TestInheritedListeners(t *testing.T) {
+	if os.Getenv(TEST_LISTEN_ENV) != "" {
+		serveInherited()
+		return
+	}
+	socket := filepath.Join(t.TempDir(), "leisure.sock")
+	unixListener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixListener.Close()
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	unixFile, err := unixListener.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixFile.Close()
+	tcpFile, err := tcpListener.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpFile.Close()
+	child := exec.Command(os.Args[0], "-test.run=^TestInheritedListeners$")
+	// LISTEN_PID has to be the child's, so the child sets it from LISTEN_FDS's presence
+	child.Env = append(os.Environ(), TEST_LISTEN_ENV+"=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=unix:tcp")
+	child.ExtraFiles = []*os.File{unixFile, tcpFile}
+	child.Stderr = os.Stderr
+	out, err := child.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer child.Wait()
+	defer child.Process.Kill()
+	var addrs map[string]string
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatalf("no addresses from child: %s", err)
+	} else if err := json.Unmarshal([]byte(line), &addrs); err != nil {
+		t.Fatalf("bad addresses from child %q: %s", line, err)
+	} else if addrs["error"] != "" {
+		t.Fatal(addrs["error"])
+	} else if addrs["unix"] != socket {
+		t.Errorf("expected UNIX socket %s, got %s", socket, addrs["unix"])
+	} else if addrs["tcp"] != tcpListener.Addr().String() {
+		t.Errorf("expected TCP address %s, got %s", tcpListener.Addr(), addrs["tcp"])
+	}
+	for _, addr := range [][]string{{"unix", socket}, {"tcp", tcpListener.Addr().String()}} {
+		conn, err := net.DialTimeout(addr[0], addr[1], time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reply, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(reply) != addr[0] {
+			t.Errorf("expected %s from the child's %s listener, got %q (%v)", addr[0], addr[0], reply, err)
+		}
+	}
+	// the child unlinks nothing it was given
+	if _, err := os.Stat(socket); err != nil {
+		t.Errorf("inherited socket was removed: %s", err)
+	}
+}
+
+// serveInherited runs in the child, answering one connection on each inherited listener
+func serveInherited() {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	unix, tcp, err := inheritedListeners()
+	if err != nil {
+		json.NewEncoder(os.Stdout).Encode(map[string]string{"error": err.Error()})
+		return
+	} else if unix == nil || tcp == nil {
+		json.NewEncoder(os.Stdout).Encode(map[string]string{"error": "missing inherited listeners"})
+		return
+	} else if os.Getenv("LISTEN_FDS") != "" || os.Getenv("LISTEN_PID") != "" {
+		json.NewEncoder(os.Stdout).Encode(map[string]string{"error": "LISTEN_FDS and LISTEN_PID were not cleared"})
+		return
+	}
+	json.NewEncoder(os.Stdout).Encode(map[string]string{"unix": unix.Addr().String(), "tcp": tcp.Addr().String()})
+	for _, l := range []net.Listener{unix, tcp} {
+		if conn, err := l.Accept(); err == nil {
+			conn.Write([]byte(l.Addr().Network()))
+			conn.Close()
+		}
+		l.Close()
+	}
+}
+
+func TestInheritedListenersIgnoresOtherPids(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getppid()))
+	t.Setenv("LISTEN_FDS", "1")
+	unix, tcp, err := inheritedListeners()
+	if unix != nil || tcp != nil || err != nil {
+		t.Errorf("expected no listeners for another process, got %v %v %v", unix, tcp, err)
+	}
+}
+
+func TestNotifyReadyPipe(t *testing.T) {
+	readyIn, readyOut, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readyIn.Close()
+	// notifyReady closes the descriptor it is given, so give it a copy
+	fd, err := syscall.Dup(int(readyOut.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readyOut.Close()
+	t.Setenv(DAEMON_READY_ENV, fmt.Sprint(fd))
+	t.Setenv("NOTIFY_SOCKET", "")
+	notifyReady()
+	msg, err := io.ReadAll(readyIn)
+	if err != nil || strings.TrimSpace(string(msg)) != "READY=1" {
+		t.Errorf("expected READY=1, got %q (%v)", msg, err)
+	} else if os.Getenv(DAEMON_READY_ENV) != "" {
+		t.Errorf("%s was not cleared", DAEMON_READY_ENV)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/org"
+	"github.com/leisure-tools/server"
+)
+
+const DOC_DIFF = server.VERSION + "/doc/diff/"
+
+// doc diff formats
+const (
+	DIFF_UNIFIED      = "unified"
+	DIFF_REPLACEMENTS = "replacements"
+	DIFF_BLOCKS       = "blocks"
+	DIFF_CONTEXT      = 3
+	// how many diagonals one split may search before settling for a larger edit
+	DIFF_MAX_COST = 1 << 24
+)
+
+var CHUNK_TYPES = map[org.OrgType]string{
+	org.HeadlineType: "headline",
+	org.TextType:     "text",
+	org.SourceType:   "source",
+	org.BlockType:    "block",
+	org.ResultsType:  "results",
+	org.HtmlType:     "html",
+	org.DrawerType:   "drawer",
+	org.KeywordType:  "keyword",
+	org.TableType:    "table",
+}
+
+type lineOp struct {
+	op   byte // ' ', '-', or '+'
+	line string
+}
+
+// chunkChange is an org chunk that was added, removed, or changed between two versions.
+// Offsets are in the new version, except for removed chunks.
+type chunkChange struct {
+	Change string    `json:"change"`
+	Id     org.OrgId `json:"id"`
+	Type   string    `json:"type"`
+	Name   string    `json:"name,omitempty"`
+	Offset int       `json:"offset"`
+	Old    string    `json:"old,omitempty"`
+	New    string    `json:"new,omitempty"`
+}
+
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines finds the shortest edit from a to b with Myers' algorithm, in linear space
+func diffLines(a, b []string) []lineOp {
+	return appendDiff(make([]lineOp, 0, len(a)+len(b)), a, b)
+}
+
+// appendDiff adds the edit from a to b to ops, splitting it at the middle of the edit
+// and diffing each side
+func appendDiff(ops []lineOp, a, b []string) []lineOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for _, line := range a[:prefix] {
+		ops = append(ops, lineOp{' ', line})
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if x, y, ok := middleSplit(midA, midB); ok {
+		ops = appendDiff(ops, midA[:x], midB[:y])
+		ops = appendDiff(ops, midA[x:], midB[y:])
+	} else {
+		for _, line := range midA {
+			ops = append(ops, lineOp{'-', line})
+		}
+		for _, line := range midB {
+			ops = append(ops, lineOp{'+', line})
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, lineOp{' ', line})
+	}
+	return ops
+}
+
+// middleSplit runs Myers' search forward from the start and backward from the end until
+// the paths meet, returning where they meet. It keeps one row of each search, so it uses
+// linear space. With nothing in common, nothing to split, or after DIFF_MAX_COST steps,
+// ok is false.
+func middleSplit(a, b []string) (int, int, bool) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+	delta := n - m
+	// with an odd delta, the forward search finds the meeting, otherwise the backward one does
+	odd := delta%2 != 0
+	// diagonals that left the grid
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+	for d, cost := 0, 0; d < maxD && cost < DIFF_MAX_COST; d, cost = d+1, cost+2*d+2 {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			x := 0
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			if x > n {
+				fEnd += 2
+			} else if y > m {
+				fStart += 2
+			} else if bk := offset + delta - k; odd && bk >= 0 && bk < len(backward) && backward[bk] != -1 {
+				if x >= n-backward[bk] {
+					return x, y, true
+				}
+			}
+		}
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			x := 0
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			if x > n {
+				bEnd += 2
+			} else if y > m {
+				bStart += 2
+			} else if fk := offset + delta - k; !odd && fk >= 0 && fk < len(forward) && forward[fk] != -1 {
+				if fx := forward[fk]; fx >= n-x {
+					return fx, fx - (fk - offset), true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// an empty range names the line before it
+		return fmt.Sprintf("%d,0", start-1)
+	} else if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// unifiedDiff formats an edit like diff -u
+func unifiedDiff(oldLabel, newLabel string, ops []lineOp) string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "--- %s\n+++ %s\n", oldLabel, newLabel)
+	oldLine, newLine := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	oldLine[0], newLine[0] = 1, 1
+	for i, op := range ops {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if op.op != '+' {
+			oldLine[i+1]++
+		}
+		if op.op != '-' {
+			newLine[i+1]++
+		}
+	}
+	for i := 0; i < len(ops); {
+		if ops[i].op == ' ' {
+			i++
+			continue
+		}
+		start := max(0, i-DIFF_CONTEXT)
+		end := i
+		// extend the hunk through changes closer than two contexts apart
+		for j := i; j < len(ops) && j < end+2*DIFF_CONTEXT+1; j++ {
+			if ops[j].op != ' ' {
+				end = j
+			}
+		}
+		end = min(len(ops), end+DIFF_CONTEXT+1)
+		fmt.Fprintf(sb, "@@ -%s +%s @@\n",
+			hunkRange(oldLine[start], oldLine[end]-oldLine[start]),
+			hunkRange(newLine[start], newLine[end]-newLine[start]))
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.op)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+// lineReplacements turns an edit into replacements in the old text's coordinates
+func lineReplacements(ops []lineOp) []history.Replacement {
+	repls := []history.Replacement{}
+	offset := 0
+	var current *history.Replacement
+	for _, op := range ops {
+		if op.op == ' ' {
+			if current != nil {
+				repls = append(repls, *current)
+				current = nil
+			}
+			offset += len(op.line)
+			continue
+		} else if current == nil {
+			current = &history.Replacement{Offset: offset}
+		}
+		if op.op == '-' {
+			current.Length += len(op.line)
+			offset += len(op.line)
+		} else {
+			current.Text += op.line
+		}
+	}
+	if current != nil {
+		repls = append(repls, *current)
+	}
+	return repls
+}
+
+// chunkDiff applies replacements to the old text's chunks and reports the chunks they added, removed, or changed
+func chunkDiff(oldText, newText string, repls []history.Replacement) []*chunkChange {
+	if oldText == "" {
+		// every chunk is new
+		added := []*chunkChange{}
+		offset := 0
+		for ch := range org.Parse(newText).Seq() {
+			basic := ch.AsOrgChunk()
+			added = append(added, &chunkChange{
+				Change: "added",
+				Id:     basic.Id,
+				Type:   CHUNK_TYPES[basic.Type],
+				Name:   org.Name(ch),
+				Offset: offset,
+				New:    basic.Text,
+			})
+			offset += len(basic.Text)
+		}
+		return added
+	}
+	chunks := org.Parse(oldText)
+	old := map[org.OrgId]*chunkChange{}
+	offset := 0
+	for ch := range chunks.Seq() {
+		basic := ch.AsOrgChunk()
+		old[basic.Id] = &chunkChange{
+			Id:     basic.Id,
+			Type:   CHUNK_TYPES[basic.Type],
+			Name:   org.Name(ch),
+			Offset: offset,
+			Old:    basic.Text,
+		}
+		offset += len(basic.Text)
+	}
+	changes := &org.ChunkChanges{}
+	// later replacements first, so the earlier offsets still hold
+	for i := len(repls) - 1; i >= 0; i-- {
+		changes.Merge(chunks.Replace(repls[i].Offset, repls[i].Length, repls[i].Text))
+	}
+	result := []*chunkChange{}
+	present := map[org.OrgId]bool{}
+	offset = 0
+	for ch := range chunks.Seq() {
+		basic := ch.AsOrgChunk()
+		present[basic.Id] = true
+		if changes.Added.Has(basic.Id) || changes.Changed.Has(basic.Id) {
+			if before := old[basic.Id]; before == nil {
+				result = append(result, &chunkChange{
+					Change: "added",
+					Id:     basic.Id,
+					Type:   CHUNK_TYPES[basic.Type],
+					Name:   org.Name(ch),
+					Offset: offset,
+					New:    basic.Text,
+				})
+			} else if before.Old != basic.Text {
+				before.Change = "changed"
+				before.Type, before.Name = CHUNK_TYPES[basic.Type], org.Name(ch)
+				before.Offset, before.New = offset, basic.Text
+				result = append(result, before)
+			}
+		}
+		offset += len(basic.Text)
+	}
+	for _, id := range changes.Removed {
+		if before := old[id]; before != nil && !present[id] {
+			before.Change = "removed"
+			result = append(result, before)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Offset < result[j].Offset })
+	return result
+}
+
+// versionText finds a version of a document by tag, by the hash of its text, or by the
+// hash of a block from doc log, the latest version if version is empty, called in the
+// service goroutine
+func (l *leisure) versionText(docId, version string) (string, error) {
+	h := l.Documents[docId]
+	if version == "" {
+		return h.GetLatestDocument().String(), nil
+	} else if tag := l.tags[docId][version]; tag != nil {
+		version = tag.Hash
+	}
+	var hash [sha256.Size]byte
+	if n, err := hex.Decode(hash[:], []byte(version)); err == nil && n == len(hash) {
+		if text := h.GetDocument(hash); text != "" {
+			return text, nil
+		} else if blk := h.GetBlock(hash); blk != nil {
+			return blk.GetDocument(h).String(), nil
+		} else if textHash(h.GetLatestDocument().String()) == version {
+			return h.GetLatestDocument().String(), nil
+		}
+	}
+	return "", fmt.Errorf("%w: no tag or version %s of document %s", ErrUnknownTag, version, docId)
+}
+
+// URL: GET /v1/doc/diff/DOC?from=VERSION&to=VERSION -- a unified diff, where versions are
+// tags, text hashes, or block hashes and to defaults to the latest version
+// URL: GET /v1/doc/diff/DOC?from=VERSION&format=replacements -- replacements for the from version
+// URL: GET /v1/doc/diff/DOC?from=VERSION&format=blocks -- the org chunks that were added, removed, or changed
+func (l *leisure) diffHandler(w http.ResponseWriter, r *http.Request) {
+	doc := unescape(strings.TrimPrefix(r.URL.Path, DOC_DIFF))
+	user := identity(r)
+	query := r.URL.Query()
+	from, to, format := query.Get("from"), query.Get("to"), query.Get("format")
+	setDefault(&format, DIFF_UNIFIED)
+	if from == "" || (format != DIFF_UNIFIED && format != DIFF_REPLACEMENTS && format != DIFF_BLOCKS) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected from=VERSION and a format of unified, replacements, or blocks", ErrBadCommand))))
+		return
+	}
+	var oldText, newText string
+	var err error
+	l.sync(func() {
+		docId := l.docId(doc)
+		if docId == "" {
+			err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, doc)
+		} else if role := l.roleFor(docId, user); !hasRole(role, ROLE_VIEWER) {
+			err = forbidden(user, role, docId, ROLE_VIEWER)
+		} else if oldText, err = l.versionText(docId, from); err == nil {
+			newText, err = l.versionText(docId, to)
+		}
+	})
+	switch server.ErrorType(err) {
+	case "":
+	case ErrForbidden.Type:
+		writeForbidden(w, err)
+		return
+	case ErrUnknownTag.Type, server.ErrUnknownDocument.Type:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(server.ErrorJSON(err)))
+		return
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+		return
+	}
+	ops := diffLines(splitLines(oldText), splitLines(newText))
+	switch format {
+	case DIFF_REPLACEMENTS:
+		writeJSON(w, lineReplacements(ops))
+	case DIFF_BLOCKS:
+		writeJSON(w, chunkDiff(oldText, newText, lineReplacements(ops)))
+	default:
+		setDefault(&to, "latest")
+		w.Header().Set("Content-Type", "text/x-diff")
+		w.WriteHeader(http.StatusOK)
+		if oldText != newText {
+			w.Write([]byte(unifiedDiff(doc+" "+from, doc+" "+to, ops)))
+		}
+	}
+}
+
+func (cmd *DocDiffCmd) Run(cli *CLI) error {
+	query := url.Values{}
+	query.Set("from", cmd.From)
+	if cmd.To != "" {
+		query.Set("to", cmd.To)
+	}
+	if cmd.Format != "" {
+		query.Set("format", cmd.Format)
+	}
+	output(cli.get(DOC_DIFF + url.PathEscape(cmd.Doc) + "?" + query.Encode()))
+	return nil
+}
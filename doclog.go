@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/server"
+)
+
+const DOC_LOG = server.VERSION + "/doc/log/"
+
+// doc log formats
+const (
+	HISTORY_TEXT = "text"
+	HISTORY_JSON = "json"
+	HISTORY_DOT  = "dot"
+)
+
+// logEntry describes a block in a document's history
+type logEntry struct {
+	Hash         string    `json:"hash"`
+	Parents      []string  `json:"parents"`
+	Peer         string    `json:"peer,omitempty"`
+	Session      string    `json:"session,omitempty"`
+	Time         time.Time `json:"time,omitempty"`
+	Head         bool      `json:"head,omitempty"`
+	Document     string    `json:"document,omitempty"` // the hash of the block's text, for doc tag and doc get --hash
+	Replacements int       `json:"replacements"`
+	Inserted     int       `json:"inserted"`
+	Deleted      int       `json:"deleted"`
+	Summary      string    `json:"summary"`
+}
+
+func shortHash(hash string) string {
+	return hash[:min(len(hash), 12)]
+}
+
+// summarize describes a block's edits, the first block holds the document's source
+func summarize(entry *logEntry, blk *history.OpBlock) {
+	entry.Replacements = len(blk.Replacements)
+	for _, repl := range blk.Replacements {
+		entry.Inserted += len(repl.Text)
+		entry.Deleted += max(repl.Length, 0)
+	}
+	if len(blk.Parents) == 0 {
+		entry.Summary = fmt.Sprintf("source, %d characters", entry.Inserted)
+		return
+	} else if entry.Replacements == 0 {
+		entry.Summary = "merge"
+		return
+	}
+	first := blk.Replacements[0]
+	preview := first.Text
+	if len(preview) > 40 {
+		preview = preview[:40] + "..."
+	}
+	entry.Summary = fmt.Sprintf("+%d -%d at %d", entry.Inserted, entry.Deleted, first.Offset)
+	if preview != "" {
+		entry.Summary += fmt.Sprintf(" %q", preview)
+	}
+	if entry.Replacements > 1 {
+		entry.Summary += fmt.Sprintf(" and %d more", entry.Replacements-1)
+	}
+}
+
+// docLog lists a document's blocks, newest first, called in the service goroutine
+func (l *leisure) docLog(docId string, documents bool, limit int) []*logEntry {
+	h := l.Documents[docId]
+	heads := h.LatestHashes()
+	order := h.GetBlockOrder()
+	entries := make([]*logEntry, 0, len(order))
+	for i := len(order) - 1; i >= 0 && (limit <= 0 || len(entries) < limit); i-- {
+		blk := h.GetBlock(order[i])
+		if blk == nil {
+			continue
+		}
+		entry := &logEntry{
+			Hash:    hex.EncodeToString(blk.Hash[:]),
+			Parents: make([]string, 0, len(blk.Parents)),
+			Peer:    blk.Peer,
+			Session: blk.SessionId,
+			Head:    slices.Contains(heads, blk.Hash),
+		}
+		for _, parent := range blk.Parents {
+			entry.Parents = append(entry.Parents, hex.EncodeToString(parent[:]))
+		}
+		entry.Time = blockTime(h, blk.Hash)
+		if documents {
+			hash := blk.GetDocumentHash(h)
+			entry.Document = hex.EncodeToString(hash[:])
+		}
+		summarize(entry, blk)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func logText(entries []*logEntry) string {
+	sb := &strings.Builder{}
+	for _, entry := range entries {
+		fmt.Fprintf(sb, "block %s", entry.Hash)
+		if entry.Head {
+			sb.WriteString(" (head)")
+		}
+		sb.WriteString("\n")
+		if len(entry.Parents) > 0 {
+			fmt.Fprintf(sb, "parents  %s\n", strings.Join(entry.Parents, " "))
+		}
+		if entry.Session != "" {
+			fmt.Fprintf(sb, "session  %s\n", entry.Session)
+		}
+		if entry.Peer != "" {
+			fmt.Fprintf(sb, "peer     %s\n", entry.Peer)
+		}
+		if !entry.Time.IsZero() {
+			fmt.Fprintf(sb, "time     %s\n", entry.Time.Format(time.RFC3339))
+		}
+		if entry.Document != "" {
+			fmt.Fprintf(sb, "document %s\n", entry.Document)
+		}
+		fmt.Fprintf(sb, "\n    %s\n\n", entry.Summary)
+	}
+	return sb.String()
+}
+
+// logDot draws the blocks as a Graphviz graph with edges from parents to children
+func logDot(docId string, entries []*logEntry) string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "digraph %s {\n", strconv.Quote(docId))
+	sb.WriteString("  rankdir=TB;\n  node [shape=box, fontname=monospace];\n")
+	for _, entry := range entries {
+		label := shortHash(entry.Hash)
+		if entry.Session != "" {
+			label += "\n" + entry.Session
+		}
+		if !entry.Time.IsZero() {
+			label += "\n" + entry.Time.Format(time.RFC3339)
+		}
+		label += "\n" + entry.Summary
+		style := ""
+		if entry.Head {
+			style = ", style=bold"
+		}
+		fmt.Fprintf(sb, "  %s [label=%s%s];\n", strconv.Quote(shortHash(entry.Hash)), strconv.Quote(label), style)
+	}
+	for _, entry := range entries {
+		for _, parent := range entry.Parents {
+			fmt.Fprintf(sb, "  %s -> %s;\n", strconv.Quote(shortHash(parent)), strconv.Quote(shortHash(entry.Hash)))
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// URL: GET /v1/doc/log/DOC -- DOC's history blocks, newest first, as JSON
+// URL: GET /v1/doc/log/DOC?format=text or ?format=dot -- as text or a Graphviz graph
+// URL: GET /v1/doc/log/DOC?limit=N&documents=true -- the newest N blocks with the hashes of their text
+func (l *leisure) logHandler(w http.ResponseWriter, r *http.Request) {
+	doc := unescape(strings.TrimPrefix(r.URL.Path, DOC_LOG))
+	user := identity(r)
+	query := r.URL.Query()
+	format := query.Get("format")
+	setDefault(&format, HISTORY_JSON)
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if format != HISTORY_TEXT && format != HISTORY_JSON && format != HISTORY_DOT {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: unknown log format %s, expected text, json, or dot", ErrBadCommand, format))))
+		return
+	}
+	var entries []*logEntry
+	var docId string
+	var err error
+	l.sync(func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%w: %v", server.ErrInternalError, p)
+			}
+		}()
+		if docId = l.docId(doc); docId == "" {
+			err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, doc)
+		} else if role := l.roleFor(docId, user); !hasRole(role, ROLE_VIEWER) {
+			err = forbidden(user, role, docId, ROLE_VIEWER)
+		} else {
+			entries = l.docLog(docId, query.Get("documents") == "true", limit)
+		}
+	})
+	switch {
+	case server.ErrorType(err) == ErrForbidden.Type:
+		writeForbidden(w, err)
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+	case format == HISTORY_JSON:
+		writeJSON(w, entries)
+	case format == HISTORY_DOT:
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(logDot(docId, entries)))
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(logText(entries)))
+	}
+}
+
+func (cmd *DocLogCmd) Run(cli *CLI) error {
+	setDefault(&cmd.Format, HISTORY_TEXT)
+	query := url.Values{}
+	query.Set("format", cmd.Format)
+	if cmd.Limit > 0 {
+		query.Set("limit", strconv.Itoa(cmd.Limit))
+	}
+	if cmd.Documents {
+		query.Set("documents", "true")
+	}
+	output(cli.get(DOC_LOG + url.PathEscape(cmd.Doc) + "?" + query.Encode()))
+	return nil
+}
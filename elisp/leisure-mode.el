@@ -473,11 +473,13 @@
       (cl-incf pos 2))
     result))
 
+;; stream update notifications, sending pending edits for each one
 (defun leisure-update ()
-  (if (and leisure-info (buffer-live-p (current-buffer)))
+  (if (and leisure-info (buffer-live-p (current-buffer))
+           (not (memq (process-status "leisure-update") '(run open))))
       (let ((buf (current-buffer)))
         (leisure-diag 1 "leisure-update %s" (string-join (list leisure-program
-                                                 "session" "update"
+                                                 "session" "stream" "--notify"
                                                  (format "--cookies=%s" (leisure-cookies)))
                                            " "))
         (setf (leisure-data-update-buffer leisure-info) "leisure-update")
@@ -486,24 +488,35 @@
          :name (leisure-data-update-buffer leisure-info)
          :buffer (leisure-data-update-buffer leisure-info)
          :command (list leisure-program
-                        "session" "update"
+                        "session" "stream" "--notify"
                         (format "--cookies=%s" (leisure-cookies)))
          :noquery t
-         :connection-type 'pty
+         :connection-type 'pipe
+         :filter (lambda (proc output) (leisure-update-output buf proc output))
          :sentinel (lambda (proc status) (leisure-update-result buf proc status))
          :stderr (leisure-data-error-buffer leisure-info)))))
 
+(defun leisure-update-output (buf proc output)
+  (with-current-buffer (process-buffer proc)
+    (goto-char (point-max))
+    (insert output)
+    (let ((updated nil))
+      (goto-char (point-min))
+      (while (search-forward "\n" nil t)
+        (let ((line (downcase (string-trim (buffer-substring (point-min) (point))))))
+          (leisure-diag 1 "stream: '%s'" line)
+          (delete-region (point-min) (point))
+          (if (string-equal "true" line)
+              (setq updated t))))
+      (if (and updated (buffer-live-p buf))
+          (with-current-buffer buf
+            (leisure-send-edit))))))
+
 (defun leisure-update-result (buf proc status)
-  (leisure-diag 1 "got update result: %s, buffer: %s" status (buffer-name))
-  (if (string-equal status "finished\n")
-      (with-current-buffer "leisure-update"
-        (let ((result (downcase (string-trim (buffer-string)))))
-          (erase-buffer)
-          (leisure-diag 1 "MALUBA! '%s'" result)
-          (if (string-equal "true" result)
-              (with-current-buffer buf
-                (leisure-send-edit))
-            (leisure-update))))))
+  (leisure-diag 1 "update stream ended: %s, buffer: %s" status (buffer-name))
+  (if (and (string-equal status "finished\n") (buffer-live-p buf))
+      (with-current-buffer buf
+        (leisure-update))))
 
 ;; cancel pending update
 (defun leisure-cancel-update ()
@@ -522,7 +535,6 @@
         (setf (leisure-data-changes leisure-info) (dl))
         (leisure-clear-timer 'activity-timer)
         (leisure-clear-timer 'flush-timer)
-        (leisure-cancel-update)
         (leisure-diag 1 "selection offset: %s len: %s" start len)
         (leisure-diag 1 "edit: %S" (leisure-map
                        "selectionOffset" start
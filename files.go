@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leisure-tools/server"
+	u "github.com/leisure-tools/utils"
+)
+
+const (
+	MAX_FILE_SIZE   = 256 << 20
+	ATTACHMENT_LINK = "attachment:"
+)
+
+var ErrFiles = server.NewLeisureError("fileFailure")
+
+var attachmentPattern = regexp.MustCompile(ATTACHMENT_LINK + `([0-9a-f]{64})`)
+
+// INLINE_TYPES are the types safe to show inline from the peer's own origin, everything
+// else, like HTML or SVG, is served as a download
+var INLINE_TYPES = u.NewSet("image/png", "image/jpeg", "image/gif", "image/webp", "image/avif", "image/bmp")
+var ErrUnknownFile = server.NewLeisureError("unknownFile")
+
+// fileStore keeps attachments by the SHA-256 of their contents
+//
+//	DIR/HASH       -- contents
+//	DIR/HASH.json  -- fileInfo
+//
+// Documents link to them with [[attachment:HASH/NAME]], served at /files/HASH/NAME.
+// An attachment is visible to whoever stored it and to the identities that can view a
+// document linking to it.
+type fileStore struct {
+	dir string
+}
+
+type fileInfo struct {
+	Hash    string    `json:"hash"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	Url     string    `json:"url"`
+	Link    string    `json:"link"`
+	Owner   string    `json:"owner,omitempty"` // the identity that stored it
+}
+
+// attachmentAccess is what an identity can do with attachments
+type attachmentAccess struct {
+	user     string
+	viewable map[string]bool // attachments linked from documents the identity can view
+	linked   map[string]bool // attachments linked from any document
+	canStore bool            // the identity can edit a document, or there are none yet
+}
+
+// filesDir is --files or STORE/files, empty when neither is given and attachments are off
+func (cmd *PeerCmd) filesDir() string {
+	if cmd.Files != "" {
+		return cmd.Files
+	} else if cmd.Store != "" {
+		return filepath.Join(cmd.Store, "files")
+	}
+	return ""
+}
+
+func openFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("%w: could not create files directory %s: %s", ErrFiles, dir, err)
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func isFileHash(str string) bool {
+	if len(str) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(str)
+	return err == nil
+}
+
+func (fst *fileStore) info(hash string) (*fileInfo, error) {
+	if !isFileHash(hash) {
+		return nil, fmt.Errorf("%w: bad file hash %s", ErrUnknownFile, hash)
+	}
+	buf, err := os.ReadFile(filepath.Join(fst.dir, hash+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: no file %s", ErrUnknownFile, hash)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: could not read file info for %s: %s", ErrFiles, hash, err)
+	}
+	info := &fileInfo{}
+	if err := json.Unmarshal(buf, info); err != nil {
+		return nil, fmt.Errorf("%w: bad file info for %s: %s", ErrFiles, hash, err)
+	}
+	return info, nil
+}
+
+// add stores contents under their hash, keeping the first name and owner if they are already stored
+func (fst *fileStore) add(name, contentType, owner string, body io.Reader) (*fileInfo, error) {
+	tmp, err := os.CreateTemp(fst.dir, ".upload-")
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not create file: %s", ErrFiles, err)
+	}
+	defer os.Remove(tmp.Name())
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), body)
+	tmp.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read upload: %s", ErrFiles, err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if info, err := fst.info(hash); err == nil {
+		return info, nil
+	}
+	name = path.Base(name)
+	if name == "." || name == "/" {
+		name = hash
+	}
+	// the CLI and forms send generic content types, so prefer the name's
+	if byName := mime.TypeByExtension(path.Ext(name)); byName != "" {
+		contentType = byName
+	} else if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	info := &fileInfo{
+		Hash:    hash,
+		Name:    name,
+		Type:    contentType,
+		Size:    size,
+		Created: time.Now().UTC(),
+		Url:     FILES_PATH + hash + "/" + url.PathEscape(name),
+		Link:    fmt.Sprintf("[[%s%s/%s][%s]]", ATTACHMENT_LINK, hash, name, name),
+		Owner:   owner,
+	}
+	buf, _ := json.Marshal(info)
+	if err := os.Rename(tmp.Name(), filepath.Join(fst.dir, hash)); err != nil {
+		return nil, fmt.Errorf("%w: could not store file %s: %s", ErrFiles, name, err)
+	} else if err := os.WriteFile(filepath.Join(fst.dir, hash+".json"), buf, 0600); err != nil {
+		return nil, fmt.Errorf("%w: could not store file info for %s: %s", ErrFiles, name, err)
+	}
+	return info, nil
+}
+
+func (fst *fileStore) list() ([]*fileInfo, error) {
+	entries, err := os.ReadDir(fst.dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read files directory %s: %s", ErrFiles, fst.dir, err)
+	}
+	infos := make([]*fileInfo, 0, len(entries)/2)
+	for _, entry := range entries {
+		if hash, ok := strings.CutSuffix(entry.Name(), ".json"); ok && isFileHash(hash) {
+			if info, err := fst.info(hash); err == nil {
+				infos = append(infos, info)
+			}
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created.Before(infos[j].Created) })
+	return infos, nil
+}
+
+func (fst *fileStore) remove(hash string) (*fileInfo, error) {
+	info, err := fst.info(hash)
+	if err != nil {
+		return nil, err
+	} else if err := os.Remove(filepath.Join(fst.dir, hash+".json")); err != nil {
+		return nil, fmt.Errorf("%w: could not delete file %s: %s", ErrFiles, hash, err)
+	}
+	os.Remove(filepath.Join(fst.dir, hash))
+	return info, nil
+}
+
+// linkedFiles finds the attachment hashes text links to, sorted
+func linkedFiles(text string) []string {
+	var hashes []string
+	for _, match := range attachmentPattern.FindAllStringSubmatch(text, -1) {
+		hashes = append(hashes, match[1])
+	}
+	slices.Sort(hashes)
+	return slices.Compact(hashes)
+}
+
+// attachmentAccess finds the attachments the documents and their tags link to from the
+// search index, called in the service goroutine
+func (l *leisure) attachmentAccess(user string) *attachmentAccess {
+	acc := &attachmentAccess{
+		user:     user,
+		viewable: map[string]bool{},
+		linked:   map[string]bool{},
+		canStore: len(l.Documents) == 0,
+	}
+	roles := map[string]string{}
+	for docId := range l.Documents {
+		roles[docId] = l.roleFor(docId, user)
+		acc.canStore = acc.canStore || hasRole(roles[docId], ROLE_EDITOR)
+	}
+	link := func(hash, docId string) {
+		acc.linked[hash] = true
+		acc.viewable[hash] = acc.viewable[hash] || hasRole(roles[docId], ROLE_VIEWER)
+	}
+	for hash, keys := range l.index.files {
+		for key := range keys {
+			link(hash, key.doc)
+		}
+	}
+	for docId, tags := range l.index.tagFiles {
+		for _, hashes := range tags {
+			for _, hash := range hashes {
+				link(hash, docId)
+			}
+		}
+	}
+	return acc
+}
+
+func (acc *attachmentAccess) canRead(info *fileInfo) bool {
+	return acc.viewable[info.Hash] || info.Owner == acc.user
+}
+
+func (acc *attachmentAccess) forbidden(action string) error {
+	user := acc.user
+	if user == "" {
+		user = "an anonymous user"
+	}
+	return fmt.Errorf("%w: %s cannot %s", ErrForbidden, user, action)
+}
+
+func writeFileError(w http.ResponseWriter, err error) {
+	if server.ErrorType(err) == ErrUnknownFile.Type {
+		w.WriteHeader(http.StatusNotFound)
+	} else if server.ErrorType(err) == ErrForbidden.Type {
+		w.WriteHeader(http.StatusForbidden)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	w.Write([]byte(server.ErrorJSON(err)))
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	buf, _ := json.Marshal(value)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+// URL: POST /files/?name=NAME -- store the body, returning its fileInfo, needs an editor of some document
+// URL: PUT /files/NAME -- store the body as NAME
+// URL: GET /files/ -- list the files the identity can see
+// URL: GET /files/HASH or /files/HASH/NAME -- get a file's contents
+// URL: DELETE /files/HASH -- only its owner, and only once no document or tag links to it
+func (l *leisure) filesHandler(w http.ResponseWriter, r *http.Request) {
+	fst := l.files
+	tail, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, FILES_PATH))
+	if err != nil {
+		writeFileError(w, fmt.Errorf("%w: bad file path %s", ErrFiles, r.URL.Path))
+		return
+	}
+	hash, _, _ := strings.Cut(tail, "/")
+	var acc *attachmentAccess
+	l.sync(func() { acc = l.attachmentAccess(identity(r)) })
+	// files the identity cannot see are reported as missing
+	visibleInfo := func() (*fileInfo, error) {
+		if info, err := fst.info(hash); err != nil {
+			return nil, err
+		} else if !acc.canRead(info) {
+			return nil, fmt.Errorf("%w: no file %s", ErrUnknownFile, hash)
+		} else {
+			return info, nil
+		}
+	}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		name := r.URL.Query().Get("name")
+		if r.Method == http.MethodPut {
+			name = tail
+		}
+		if name == "" {
+			writeFileError(w, fmt.Errorf("%w: expected a file name", ErrFiles))
+		} else if !acc.canStore {
+			writeFileError(w, acc.forbidden("edit any document, which storing attachments needs"))
+		} else if info, err := fst.add(name, r.Header.Get("Content-Type"), acc.user, http.MaxBytesReader(w, r.Body, MAX_FILE_SIZE)); err != nil {
+			writeFileError(w, err)
+		} else {
+			writeJSON(w, info)
+		}
+	case http.MethodDelete:
+		if found, err := visibleInfo(); err != nil {
+			writeFileError(w, err)
+		} else if acc.linked[hash] {
+			writeFileError(w, fmt.Errorf("%w: a document links to file %s, remove the links before deleting it", ErrFiles, hash))
+		} else if found.Owner != acc.user {
+			writeFileError(w, acc.forbidden("delete file "+hash+", which it did not store"))
+		} else if removed, err := fst.remove(hash); err != nil {
+			writeFileError(w, err)
+		} else {
+			writeJSON(w, removed)
+		}
+	case http.MethodGet, http.MethodHead:
+		if tail == "" {
+			if infos, err := fst.list(); err != nil {
+				writeFileError(w, err)
+			} else {
+				visible := make([]*fileInfo, 0, len(infos))
+				for _, info := range infos {
+					if acc.canRead(info) {
+						visible = append(visible, info)
+					}
+				}
+				writeJSON(w, visible)
+			}
+		} else if info, err := visibleInfo(); err != nil {
+			writeFileError(w, err)
+		} else if file, err := os.Open(filepath.Join(fst.dir, hash)); err != nil {
+			writeFileError(w, fmt.Errorf("%w: could not read file %s: %s", ErrFiles, hash, err))
+		} else {
+			defer file.Close()
+			mediaType, _, _ := mime.ParseMediaType(info.Type)
+			w.Header().Set("Content-Type", info.Type)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Content-Security-Policy", "sandbox")
+			if !INLINE_TYPES.Has(mediaType) {
+				w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name}))
+			}
+			w.Header().Set("ETag", `"`+hash+`"`)
+			// contents never change for a hash
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			http.ServeContent(w, r, info.Name, info.Created, file)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, DELETE")
+		writeFileError(w, fmt.Errorf("%w: unsupported method %s", ErrFiles, r.Method))
+	}
+}
+
+func (cmd *FileAddCmd) Run(cli *CLI) error {
+	buf, err := os.ReadFile(cmd.File)
+	if err != nil {
+		panicWith("%w: could not read %s: %s", ErrFiles, cmd.File, err)
+	}
+	name := cmd.Name
+	if name == "" {
+		name = filepath.Base(cmd.File)
+	}
+	output(cli.request(http.MethodPut, bytes.NewReader(buf), FILES_PATH, name))
+	return nil
+}
+
+func (cmd *FileListCmd) Run(cli *CLI) error {
+	output(cli.get(FILES_PATH))
+	return nil
+}
+
+func (cmd *FileGetCmd) Run(cli *CLI) error {
+	resp := cli.get(FILES_PATH, cmd.Hash)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		output(resp)
+		return nil
+	}
+	out := os.Stdout
+	if cmd.Output != "" {
+		file, err := os.Create(cmd.Output)
+		if err != nil {
+			panicWith("%w: could not create %s: %s", ErrFiles, cmd.Output, err)
+		}
+		defer file.Close()
+		out = file
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		panicWith("%w: could not write file: %s", ErrFiles, err)
+	}
+	return nil
+}
+
+func (cmd *FileDeleteCmd) Run(cli *CLI) error {
+	output(cli.request(http.MethodDelete, nil, FILES_PATH, cmd.Hash))
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/org"
+	"github.com/leisure-tools/server"
+)
+
+const (
+	DOC_FORK     = server.VERSION + "/doc/fork/"
+	DOC_MERGE    = server.VERSION + "/doc/merge/"
+	MERGE_PREFIX = "MERGE-"
+)
+
+var ErrMerge = server.NewLeisureError("mergeFailure")
+
+// forkInfo records where a fork came from, the fork's source text is the version it started at
+type forkInfo struct {
+	Id      string    `json:"id"`
+	Source  string    `json:"source"`
+	Version string    `json:"version"`
+	Author  string    `json:"author,omitempty"`
+	Created time.Time `json:"created"`
+	Text    string    `json:"text,omitempty"` // the version's text, once compacting drops the fork's source
+}
+
+// documentForks maps forks to where they came from
+type documentForks map[string]*forkInfo
+
+// sessionText is the document as a session last saw it
+func sessionText(s *server.LeisureSession) string {
+	return s.LatestBlock().GetDocument(s.History).String()
+}
+
+// forkDocument copies a version of a document into a new one, called in the service goroutine.
+// The fork has the source's members, with the identity forking it as an owner.
+func (l *leisure) forkDocument(docId, version, id, alias, user string) (*forkInfo, error) {
+	if id == "" {
+		key := make([]byte, 16)
+		rand.Read(key)
+		id = hex.EncodeToString(key)
+	}
+	if l.Documents[id] != nil {
+		return nil, fmt.Errorf("%w: there is already a document %s", server.ErrDocumentExists, id)
+	} else if alias != "" && l.DocumentAliases[alias] != "" {
+		return nil, fmt.Errorf("%w: there is already a document with alias %s", server.ErrDocumentAliasExists, alias)
+	}
+	text, err := l.versionText(docId, version)
+	if err != nil {
+		return nil, err
+	}
+	if members := l.members[docId]; len(members) > 0 {
+		forkMembers := map[string]string{}
+		for member, role := range members {
+			forkMembers[member] = role
+		}
+		if user != "" {
+			forkMembers[user] = ROLE_OWNER
+		}
+		l.members[id] = forkMembers
+	}
+	info := &forkInfo{Id: id, Source: docId, Version: textHash(text), Author: user, Created: time.Now().UTC()}
+	l.forks[id] = info
+	l.addDocument(id, alias, text)
+	if l.store != nil {
+		l.store.saveMeta()
+	}
+	return info, nil
+}
+
+// mergeBase finds the version two documents share, one must be a fork of the other
+func (l *leisure) mergeBase(src, dest string) (string, error) {
+	fork := src
+	if info := l.forks[src]; info == nil || info.Source != dest {
+		if info := l.forks[dest]; info == nil || info.Source != src {
+			return "", fmt.Errorf("%w: neither %s nor %s is a fork of the other", ErrMerge, src, dest)
+		}
+		fork = dest
+	}
+	if text := l.forks[fork].Text; text != "" {
+		return text, nil
+	}
+	h := l.Documents[fork]
+	return h.Source.GetDocument(h).String(), nil
+}
+
+// mergeDocument brings changes in src since the last merge into dest, called in the service goroutine.
+//
+// A MERGE-OUT session on src remembers what was merged last, starting at the version the
+// fork shares with its source, and a MERGE-IN session on dest commits the changes, so the
+// history merges them with dest's concurrent edits like any session's. The changes are
+// moved past edits dest had already made when its session last looked, and where both
+// documents changed the same lines dest's lines stay ahead of the merged ones.
+func (l *leisure) mergeDocument(src, dest, user, role string) (int, error) {
+	base, err := l.mergeBase(src, dest)
+	if err != nil {
+		return 0, err
+	}
+	outId := MERGE_PREFIX + "OUT-" + src + "-" + dest
+	inId := MERGE_PREFIX + "IN-" + src + "-" + dest
+	out := l.Sessions[outId]
+	from := base
+	if out != nil {
+		from = sessionText(out)
+	}
+	to := l.Documents[src].GetLatestDocument().String()
+	in := l.Sessions[inId]
+	if in == nil {
+		if in, err = l.AddSession(inId, l.Documents[dest], false, true, false, 0); err != nil {
+			return 0, err
+		} else if _, _, _, err = in.Commit(0, 0, &org.ChunkChanges{}); err != nil {
+			return 0, err
+		}
+	}
+	changes := lineReplacements(diffLines(splitLines(from), splitLines(to)))
+	moved := lineReplacements(diffLines(splitLines(from), splitLines(sessionText(in))))
+	repls := make([]history.Replacement, 0, len(changes))
+	for _, change := range changes {
+		start := mapOffset(change.Offset, moved, false)
+		end := max(start, mapOffset(change.Offset+change.Length, moved, false))
+		repls = append(repls, history.Replacement{Offset: start, Length: end - start, Text: change.Text})
+	}
+	if err := l.checkSessionRegions(dest, inId, user, role, repls); err != nil {
+		return 0, err
+	}
+	for _, repl := range repls {
+		in.Replace(repl.Offset, repl.Length, repl.Text)
+	}
+	if _, _, _, err := in.Commit(0, 0, &org.ChunkChanges{}); err != nil {
+		return 0, err
+	}
+	// src's changes are merged up to here
+	if out == nil {
+		if out, err = l.AddSession(outId, l.Documents[src], false, true, false, 0); err != nil {
+			return 0, err
+		}
+	}
+	if _, _, _, err := out.Commit(0, 0, &org.ChunkChanges{}); err != nil {
+		return 0, err
+	}
+	return len(repls), nil
+}
+
+// URL: POST /v1/doc/fork/DOC -- body {"at": VERSION, "id": ID, "alias": ALIAS}, where the version
+// is a tag, text hash, or block hash and defaults to the latest, returns the new document's forkInfo
+// URL: POST /v1/doc/merge/SRC/DEST -- merge SRC's changes into DEST, when one is a fork of the other
+func (l *leisure) forkHandler(w http.ResponseWriter, r *http.Request) {
+	user := identity(r)
+	var fork struct {
+		At    string `json:"at"`
+		Id    string `json:"id"`
+		Alias string `json:"alias"`
+	}
+	merging := strings.HasPrefix(r.URL.Path, DOC_MERGE)
+	src, dest := "", ""
+	if merging {
+		src, dest, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, DOC_MERGE), "/")
+		src, dest = unescape(src), unescape(dest)
+	} else {
+		src = unescape(strings.TrimPrefix(r.URL.Path, DOC_FORK))
+		if err := json.NewDecoder(r.Body).Decode(&fork); err != nil && err != io.EOF {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected {\"at\": VERSION, \"id\": ID, \"alias\": ALIAS}", ErrBadCommand))))
+			return
+		}
+	}
+	if r.Method != http.MethodPost || src == "" || (merging && dest == "") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected POST %sDOC or %sSRC/DEST", ErrBadCommand, DOC_FORK, DOC_MERGE))))
+		return
+	}
+	var result any
+	var err error
+	l.sync(func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%w: %v", ErrMerge, p)
+			}
+		}()
+		srcId, destId := l.docId(src), l.docId(dest)
+		if srcId == "" {
+			err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, src)
+		} else if merging && destId == "" {
+			err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, dest)
+		} else if role := l.roleFor(srcId, user); !hasRole(role, ROLE_VIEWER) {
+			err = forbidden(user, role, srcId, ROLE_VIEWER)
+		} else if !merging {
+			result, err = l.forkDocument(srcId, fork.At, fork.Id, fork.Alias, user)
+		} else if role := l.roleFor(destId, user); !hasRole(role, ROLE_EDITOR) {
+			err = forbidden(user, role, destId, ROLE_EDITOR)
+		} else {
+			var count int
+			if count, err = l.mergeDocument(srcId, destId, user, role); err == nil {
+				result = map[string]any{"source": srcId, "destination": destId, "replacements": count}
+			}
+		}
+	})
+	switch server.ErrorType(err) {
+	case "":
+		writeJSON(w, result)
+	case ErrForbidden.Type, ErrProtectedRegion.Type:
+		writeForbidden(w, err)
+	case server.ErrUnknownDocument.Type, ErrUnknownTag.Type:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(server.ErrorJSON(err)))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+	}
+}
+
+func (cmd *DocForkCmd) Run(cli *CLI) error {
+	body, _ := json.Marshal(map[string]string{"at": cmd.At, "id": cmd.Id, "alias": cmd.Alias})
+	output(cli.request(http.MethodPost, bytes.NewReader(body), DOC_FORK, cmd.Doc))
+	return nil
+}
+
+func (cmd *DocMergeCmd) Run(cli *CLI) error {
+	output(cli.request(http.MethodPost, nil, DOC_MERGE, cmd.Src, cmd.Dest))
+	return nil
+}
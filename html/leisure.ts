@@ -8,6 +8,7 @@ const SESSION_CREATE = VERSION + '/session/create/'
 const SESSION_LIST = VERSION + '/session/list'
 const SESSION_DOC = VERSION + '/session/document'
 const SESSION_UPDATE = VERSION + '/session/update'
+const SESSION_STREAM = VERSION + '/session/stream'
 const SESSION_EDIT = VERSION + '/session/edit'
 const SESSION_GET = VERSION + '/session/get'
 const SESSION_SET = VERSION + '/session/set'
@@ -55,6 +56,7 @@ export class Leisure {
   errorHandler: (err: string) => any
   updating: false
   dead: false
+  events: EventSource
 
   constructor(server: string, sessionName: string, documentId: string) {
     this.server = new URL(server).href
@@ -178,37 +180,46 @@ export class Leisure {
     }
   }
 
-  async updateLoop(
+  // listen for updates on the session's event stream and send pending edits for each one
+  updateLoop(
     generate: UpdateGenerator,
     handle: UpdateHandler,
     error: (err: string) => any,
   ) {
     this.updateHandler = handle
     this.errorHandler = error
-    try {
-      const hasUpdate = await this.update()
-      if (hasUpdate) {
-        // There is an update pending, process it
-        const currentEdit = this.protect(
-          'generating edits for update',
-          generate,
-        )
-        await this.doEdits(currentEdit)
-        //let pendingEdits = await this.edit(currentEdit)
-        //console.log('GOT EDITS', pendingEdits)
-        //const result = this.protect('handling update edit response', () =>
-        //  handle(pendingEdits),
-        //)
-        //if (result instanceof Promise) {
-        //  await result
-        //}
+    const url = new URL(SESSION_STREAM, this.server)
+    // notify mode leaves the session alone so edits generated here stay valid
+    url.searchParams.set('notify', 'true')
+    this.events?.close()
+    this.events = new EventSource(url.href)
+    let busy = false
+    let pending = false
+    this.events.addEventListener('update', async () => {
+      if (busy) {
+        pending = true
+        return
       }
-    } catch (err) {
-      this.error(err)
-      return
-    }
-    // wait for another update and handle it
-    setTimeout(() => this.updateLoop(generate, handle, error))
+      busy = true
+      do {
+        pending = false
+        try {
+          const currentEdit = this.protect(
+            'generating edits for update',
+            generate,
+          )
+          await this.doEdits(currentEdit)
+        } catch (err) {
+          this.error(err)
+        }
+      } while (pending)
+      busy = false
+    })
+    this.events.addEventListener('failure', (evt: MessageEvent) => {
+      this.events.close()
+      error(this.error(evt.data, 'Error while streaming updates').message)
+    })
+    this.events.addEventListener('stopping', () => this.events.close())
   }
 
   protect<T>(doingWhat: string, code: () => T): T {
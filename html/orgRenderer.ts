@@ -11,6 +11,8 @@ const VIEW_RE =
   /#\+begin_src +html (?:[^\n]+ )?:view +([^\n \/]+)(?:\/([^\n ]+))?(?: [^\n]+)?\n/is
 const LEISURE_LINK_RE = /^leisure:(.*)$/i
 const HREF_LINK_RE = /^http(s)?:.*$/i
+const ATTACHMENT_LINK_RE = /^attachment:([0-9a-f]{64})(?:\/(.*))?$/i
+const IMAGE_RE = /\.(png|jpe?g|gif|svg|webp)$/i
 const KEYWORD_RE = /^(#\+)([^ \n]+)(: *)([^ \n]*)( *\n)$/i
 const Prism = WINDOW.Prism as any
 const LEISURE_PATH = /^@?([-\w])((?:\.[\[\]\w])*)/
@@ -272,6 +274,11 @@ function isDrawer(ch: Chunk): ch is Drawer {
   return ch.type === "drawer"
 }
 
+// escapeHtml makes text safe for element content and quoted attributes
+function escapeHtml(text: string) {
+  return text.replace(/[&<>"']/g, (c) => `&#${c.charCodeAt(0)};`)
+}
+
 export function renderText(text: string) {
   const orig = text
   let pos = 0
@@ -311,6 +318,14 @@ export function renderText(text: string) {
             ref = ref.slice(0, slashInd)
           }
           result += `<div class='leisure-view' data-view='${ref}' data-namespace='${namespace}'></div>`
+        } else if (link.match(ATTACHMENT_LINK_RE)) {
+          const [, hash, name] = link.match(ATTACHMENT_LINK_RE)
+          const url = `/files/${hash}/${encodeURIComponent(name ?? hash)}`
+          if (!mark[2] && name?.match(IMAGE_RE)) {
+            result += `<img src='${url}' alt='${escapeHtml(name)}'>`
+          } else {
+            result += `<a href='${url}'>${escapeHtml(mark[2] || name || hash)}</a>`
+          }
         } else if (link.match(HREF_LINK_RE)) {
           result += `<a href='${mark[1]}'>${mark[2] || ""}</span>`
         } else {
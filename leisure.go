@@ -12,6 +12,7 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"log/slog"
 	"maps"
 	"net"
 	"net/http"
@@ -24,6 +25,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aki237/nscjar"
@@ -76,11 +79,11 @@ func (ofs *Overlay) Open(name string) (file fs.File, err error) {
 func (ofs *Overlay) Add(name string) error {
 	if info, err := os.Stat(name); err != nil {
 		if os.IsNotExist(err) {
-			panic("File " + name + " does not exist")
+			return fmt.Errorf("%w: html directory %s does not exist", ErrConfig, name)
 		}
-		panic("Could not open dirctory " + name)
+		return fmt.Errorf("%w: could not open html directory %s: %s", ErrConfig, name, err)
 	} else if !info.IsDir() {
-		panic("Not a dirctory: " + name)
+		return fmt.Errorf("%w: html path %s is not a directory", ErrConfig, name)
 	}
 	ofs.stack = append(ofs.stack, os.DirFS(name))
 	return nil
@@ -88,18 +91,8 @@ func (ofs *Overlay) Add(name string) error {
 
 var htmlDirs = make([]fs.FS, 0, 4)
 
-func verbose(reqLevel, level int, format string, args ...any) {
-	if reqLevel <= level {
-		fmt.Fprintf(os.Stderr, format+"\n", args...)
-	}
-}
-
-func (cli *CLI) verbose(level int, format string, args ...any) {
-	verbose(level, cli.globals.Verbose, format, args...)
-}
-
-func (l *leisure) verbose(level int, format string, args ...any) {
-	verbose(level, l.Verbose, format, args...)
+func (cli *CLI) log() *slog.Logger {
+	return logFor(LOG_CLI)
 }
 
 func concat[T any](array []T, values ...T) []T {
@@ -107,7 +100,7 @@ func concat[T any](array []T, values ...T) []T {
 }
 
 func (cli *CLI) lockName() string {
-	cli.verbose(1, "LOCK, COOKIES: %s", cli.globals.Cookies)
+	cli.log().Debug("lock", "cookies", cli.globals.Cookies)
 	if cookieFile, err := filepath.Abs(cli.globals.Cookies); err != nil {
 		panic(err)
 	} else {
@@ -189,7 +182,7 @@ type Cmd interface {
 
 func (cli *CLI) check() {
 	if cli.globals.Cookies != "" {
-		cli.verbose(1, "Using cookie file %s", cli.globals.Cookies)
+		cli.log().Debug("using cookie file", "cookies", cli.globals.Cookies)
 		if cli.globals.ForceLock {
 			cli.globals.Lock = true
 		}
@@ -202,18 +195,57 @@ func (cli *CLI) check() {
 }
 
 func (cmd *PeerCmd) Run(cli *CLI) error {
-	cli.verbose(1, "PEER")
 	if html, err := fs.Sub(html, "html"); err != nil {
 		panic(err)
 	} else {
 		cmd.ofs = &Overlay{append(make([]fs.FS, 0, 2), html)}
 	}
+	for _, dir := range cmd.Html {
+		if err := cmd.ofs.Add(dir); err != nil {
+			panicWith("%w", err)
+		}
+	}
+	if cmd.Daemon && !isDaemonChild() {
+		cmd.daemonize()
+		return nil
+	}
+	logFile := cmd.LogFile
+	if isDaemonChild() {
+		// the daemon's output already goes to its log file
+		logFile = ""
+	}
+	if err := configureLogging(cmd.Verbose, cmd.LogLevel, cmd.LogFormat, logFile); err != nil {
+		panicWith("%w", err)
+	} else if err := logSessions(); err != nil {
+		panicWith("%w", err)
+	}
+	plog := logFor(LOG_PEER)
+	plog.Debug("starting peer", "pid", os.Getpid(), "socket", cmd.UnixSocket)
+	listener, tcpListener, err := inheritedListeners()
+	if err != nil {
+		panicWith("%w", err)
+	} else if listener == nil {
+		if listener, err = cmd.listenUnix(); err != nil {
+			panicWith("%w", err)
+		}
+	} else {
+		plog.Info("using inherited unix socket", "addr", listener.Addr().String())
+	}
+	cmd.writePidFile()
 	mux := http.NewServeMux()
-	sv := server.Initialize(cmd.UnixSocket, mux, server.MemoryStorage)
-	inst := &leisure{
-		LeisureService: sv,
-		Monitors:       make(map[string]*docMonitor),
+	storage := timedMemoryStorage
+	var store *docStore
+	if cmd.Store != "" {
+		if store, err = openStore(cmd.Store); err != nil {
+			panicWith("%w", err)
+		}
+		storage = store.storage
 	}
+	sv := server.Initialize(cmd.UnixSocket, mux, storage)
+	inst := newLeisure(sv, store, storage, peerIdFor(cmd.UnixSocket))
+	inst.pidFile = cmd.PidFile
+	inst.linkCaCert = cmd.ReplicateCaCert
+	sv.AddListener(inst)
 	if m := monitor.MON_PAT.FindStringSubmatch(cmd.Monitor); m != nil {
 		inUser := m[monitor.MON_PAT.SubexpIndex("user")]
 		inPass := m[monitor.MON_PAT.SubexpIndex("pass")]
@@ -249,34 +281,92 @@ func (cmd *PeerCmd) Run(cli *CLI) error {
 			inHost = inUser + inHost
 		}
 		conStr := fmt.Sprintf("redis://%s:%s/%s", inHost, inPort, inDb)
-		inst.initMonitor(mux, conStr, tlsConfig, cmd.Verbose)
+		inst.initMonitor(mux, conStr, tlsConfig, verbosityFor(LOG_MONITOR))
+	}
+	if store != nil {
+		if err := store.load(sv); err != nil {
+			panicWith("%w", err)
+		}
+		sv.AddListener(store)
+		for id := range sv.Documents {
+			inst.NewDocument(sv, id)
+		}
+	}
+	if cmd.Watch != "" {
+		if w, err := newFileWatcher(inst, cmd.Watch); err != nil {
+			panicWith("%w", err)
+		} else {
+			go w.run()
+		}
+	}
+	if dir := cmd.filesDir(); dir != "" {
+		files, err := openFileStore(dir)
+		if err != nil {
+			panicWith("%w", err)
+		}
+		inst.files = files
+		mux.HandleFunc(FILES_PATH, inst.filesHandler)
 	}
-	//if opts.localFiles != "" {
-	//	opts.ofs.Add(opts.localFiles)
-	//}
 	mux.Handle("/", http.FileServer(http.FS(cmd.ofs)))
-	sv.SetVerbose(cmd.Verbose)
+	sv.SetVerbose(verbosityFor(LOG_SESSION))
 	//fmt.Fprintln(os.Stderr, "Leisure", strings.Join(args, " "))
-	var listener *net.UnixListener
+	mux.HandleFunc(SHUTDOWN, inst.shutdownHandler)
+	mux.HandleFunc(METRICS_PATH, inst.metricsHandler)
+	mux.HandleFunc(REPLICATE, inst.replicateHandler)
+	mux.HandleFunc(REPLICATE_HELLO, inst.helloHandler)
+	mux.HandleFunc(SESSION_STREAM, inst.streamHandler(mux))
+	mux.HandleFunc(DOC_MEMBERS, inst.membersHandler)
+	mux.HandleFunc(DOC_REGIONS, inst.regionsHandler)
+	mux.HandleFunc(COMMENTS, inst.commentsHandler)
+	mux.HandleFunc(DOC_MARKERS, inst.markersHandler)
+	mux.HandleFunc(DOC_TAGS, inst.tagsHandler)
+	mux.HandleFunc(DOC_LOG, inst.logHandler)
+	mux.HandleFunc(DOC_DIFF, inst.diffHandler)
+	mux.HandleFunc(DOC_FORK, inst.forkHandler)
+	mux.HandleFunc(DOC_MERGE, inst.forkHandler)
+	mux.HandleFunc(DOC_EXPORT, inst.exportHandler)
+	mux.HandleFunc(DOC_IMPORT, inst.importHandler)
+	mux.HandleFunc(DOC_COMPACT, inst.compactHandler)
+	mux.HandleFunc(DOC_DELETE, inst.deleteHandler)
+	mux.HandleFunc(DOC_ALIASES, inst.aliasesHandler)
+	mux.HandleFunc(DOC_RENAME, inst.renameHandler)
+	mux.HandleFunc(SEARCH, inst.searchHandler)
+	mux.HandleFunc(BLOCKS, inst.blocksHandler)
 	die = func() {
-		if listener != nil {
-			listener.Close()
-		}
+		inst.shutdown("exit")
 		os.Exit(exitCode)
 	}
-	if cmd.Port != 0 {
-		go http.ListenAndServe(fmt.Sprintf("localhost:%d", cmd.Port), mux)
+	inst.handleSignals()
+	users, err := readUsers(cmd.Users)
+	if err != nil {
+		panicWith("%w", err)
 	}
-	cli.verbose(1, "UNIX SOCKET: %s", cmd.UnixSocket)
-	if addr, err := net.ResolveUnixAddr("unix", cmd.UnixSocket); err != nil {
-		panicWith("%w: could not resolve unix socket %s", ErrSocketFailure, cmd.UnixSocket)
-	} else if listener, err = net.ListenUnix("unix", addr); err != nil {
-		panicWith("%w: could not listen on unix socket %s", ErrSocketFailure, cmd.UnixSocket)
-	} else {
-		listener.SetUnlinkOnClose(true)
-		cli.verbose(1, "RUNNING UNIX DOMAIN SERVER: %s", addr)
-		log.Fatal(http.Serve(listener, &myMux{mux}))
+	if cmd.Port != 0 || tcpListener != nil {
+		srv, tcp, err := cmd.listenTcp(inst, tcpListener, users, inst.metrics.instrument(inst.stopGuard(inst.accessGuard(mux))))
+		if err != nil {
+			panicWith("%w", err)
+		}
+		go serveTcp(srv, tcp)
+	}
+	for _, peer := range cmd.Replicate {
+		if _, err := inst.replicate(peer, cmd.ReplicateToken); server.ErrorType(err) == ErrLinkRefused.Type {
+			// the other peer links to this one, which replicates both ways already
+			plog.Warn("not replicating", "peer", peer, "error", err)
+		} else if err != nil {
+			panicWith("%w", err)
+		}
+	}
+	plog.Info("running unix domain server", "socket", cmd.UnixSocket)
+	srv := inst.addServer(&http.Server{
+		Handler:     inst.metrics.instrument(inst.stopGuard(inst.accessGuard(&myMux{mux}))),
+		ConnContext: socketContext,
+	})
+	notifyReady()
+	if err := srv.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
+	<-inst.stopped
+	os.Exit(exitCode)
 	return nil
 }
 
@@ -288,10 +378,47 @@ type leisure struct {
 	*server.LeisureService
 	*monitor.Monitoring
 	Monitors map[string]*docMonitor
+	store    *docStore
+	storage  func(id, content string) history.DocStorage
+	// shutdown state
+	stopping   atomic.Bool
+	stopOnce   sync.Once
+	stopped    chan bool
+	serverLock sync.Mutex
+	servers    []*http.Server
+	pidFile    string
+	metrics    *peerMetrics
+	// names this peer to the peers it replicates with
+	peerId string
+	// certificate file to trust for the peers this one links to
+	linkCaCert string
+	// peers to replicate with, by url
+	replicators map[string]*replicator
+	// document -> identity -> role, shared with the store's metadata
+	members documentMembers
+	// document -> locked regions, shared with the store's metadata
+	regions documentRegions
+	// comment document -> comment, shared with the store's metadata
+	comments documentComments
+	// document -> marker id -> marker, shared with the store's metadata
+	markers documentMarkers
+	// document -> session that moves its markers
+	markerSessions map[string]*markerSession
+	// document -> tag name -> version, shared with the store
+	tags documentTags
+	// fork -> where it came from, shared with the store's metadata
+	forks documentForks
+	// deleted document -> tombstone, shared with the store's metadata
+	deleted deletedDocuments
+	// attachments
+	files *fileStore
+	// words in every document
+	index *searchIndex
 }
 
 type lcontext struct {
 	*server.LeisureContext
+	leisure *leisure
 }
 
 // only supports exclusive LeisureSessions for now
@@ -301,6 +428,8 @@ type docMonitor struct {
 	*server.LeisureSession
 	lastUpdate   int64
 	blockSerials map[org.OrgId]string
+	stats        monitorMetrics
+	logger       *slog.Logger
 }
 
 func (mux *myMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -312,16 +441,22 @@ func (mux *myMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (cli *CLI) httpClient() *http.Client {
 	if cli.globals.Host != "" {
-		cli.verbose(1, "USING HOST: %s:%i", cli.globals.Host, cli.globals.Port)
-		return &http.Client{
-			Transport: &http.Transport{
-				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-					return net.Dial("tcp", fmt.Sprint(cli.globals.Host, ":", cli.globals.Port))
-				},
+		cli.log().Debug("using host", "host", cli.globals.Host, "port", cli.globals.Port)
+		transport := &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("tcp", fmt.Sprint(cli.globals.Host, ":", cli.globals.Port))
 			},
 		}
+		if isTrue(cli.globals.Tls) {
+			conf, err := tlsClientConfig(cli.globals.CaCert)
+			if err != nil {
+				panicWith("%w", err)
+			}
+			transport.TLSClientConfig = conf
+		}
+		return &http.Client{Transport: transport}
 	}
-	cli.verbose(1, "USING UNIX SOCKET: '%s'", cli.globals.UnixSocket)
+	cli.log().Debug("using unix socket", "socket", cli.globals.UnixSocket)
 	return &http.Client{
 		Transport: &http.Transport{
 			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
@@ -342,7 +477,11 @@ func (cli *CLI) request(method string, body io.Reader, urlStr string, moreUrl ..
 	if cli.globals.Port != 0 {
 		hostname += fmt.Sprint(":", cli.globals.Port)
 	}
-	uri := fmt.Sprint("http://", hostname)
+	scheme := "http://"
+	if isTrue(cli.globals.Tls) && cli.globals.Host != "" {
+		scheme = "https://"
+	}
+	uri := fmt.Sprint(scheme, hostname)
 	if path, err := url.JoinPath(urlStr, moreUrl...); err != nil {
 		cli.globals.ctx.PrintUsage(true)
 		return nil
@@ -354,11 +493,14 @@ func (cli *CLI) request(method string, body io.Reader, urlStr string, moreUrl ..
 			Host:   req.URL.Host,
 			Opaque: path,
 		}
-		cli.verbose(1, "%s %s", method, req.URL.String())
+		cli.log().Debug("request", "method", method, "url", req.URL.String())
 		if body != nil {
 			req.Header.Set("Content-Type", "text/plain")
 		}
-		cli.verbose(1, "Cookies: %s", cli.globals.Cookies)
+		if cli.globals.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+cli.globals.Token)
+		}
+		cli.log().Debug("cookies", "cookies", cli.globals.Cookies)
 		if cli.globals.Cookies != "" {
 			jar := nscjar.Parser{}
 			if file, err := os.Open(cli.globals.Cookies); err == nil {
@@ -380,7 +522,7 @@ func (cli *CLI) request(method string, body io.Reader, urlStr string, moreUrl ..
 				if file, err := os.Create(cli.globals.Cookies); err != nil {
 					panicWith("%w: could not write cookie file %s", ErrCookieFailure, cli.globals.Cookies)
 				} else {
-					cli.verbose(1, "Cookies:%v", resp.Cookies())
+					cli.log().Debug("received cookies", "cookies", fmt.Sprint(resp.Cookies()))
 					for _, cookie := range resp.Cookies() {
 						if err := jar.Marshal(file, cookie); err != nil {
 							panicWith("%w: could not write cookie file %s", ErrCookieFailure, cli.globals.Cookies)
@@ -452,15 +594,6 @@ func outputBasic(resp *http.Response, parseJson bool) {
 	fmt.Print(obj)
 }
 
-func (cmd *StopCmd) Run(cli *CLI) error {
-	cli.globals.UnixSocket = cmd.UnixSocket
-	cli.globals.Port = cmd.Port
-	cli.globals.Host = cmd.Host
-	cli.globals.Verbose = cmd.Verbose
-	cli.get(server.STOP)
-	return nil
-}
-
 func (cmd *DocCreateCmd) Run(cli *CLI) error {
 	if cmd.DocId == "" {
 		key := make([]byte, 16)
@@ -491,7 +624,13 @@ func (cmd *DocGetCmd) Run(cli *CLI) error {
 		}
 		args = append(args, prefix, key, "=", value)
 	}
-	if cmd.Hash != "" {
+	if cmd.Tag != "" {
+		hash, ok := cli.tagHash(cmd.DocId, cmd.Tag)
+		if !ok {
+			return nil
+		}
+		addQuery("hash", hash)
+	} else if cmd.Hash != "" {
 		addQuery("hash", cmd.Hash)
 	}
 	if cmd.Dump {
@@ -599,7 +738,7 @@ func (cmd *SessionConnectCmd) Run(cli *CLI) error {
 	if len(query) > 0 {
 		q = "?" + strings.Join(query, "&")
 	}
-	cli.verbose(1, "sending session connect: %s", url+q)
+	cli.log().Debug("sending session connect", "url", url+q)
 	resp, post := cli.postOrGet(url + q)
 	if post || resp.StatusCode != http.StatusOK {
 		output(resp)
@@ -612,7 +751,7 @@ func (cmd *SessionConnectCmd) Run(cli *CLI) error {
 		} else if errObj, ok := obj.(map[string]any); ok && errObj["error"] != "" {
 			errObj["args"] = os.Args
 			if j, jerr := json.Marshal(errObj); jerr == nil {
-				fmt.Printf(string(j))
+				fmt.Print(string(j))
 				return nil
 			}
 		}
@@ -656,6 +795,73 @@ func (cmd *GetCmd) get(cli *CLI) error {
 	return nil
 }
 
+// run fn in the service goroutine and wait for it to finish
+func (l *leisure) sync(fn func()) {
+	done := make(chan bool, 1)
+	l.Svc(func() {
+		defer func() { done <- true }()
+		fn()
+	})
+	<-done
+}
+
+// newLeisure makes a peer around a service whose documents are kept in storage and,
+// if store is not nil, in a store directory
+func newLeisure(sv *server.LeisureService, store *docStore, storage func(id, content string) history.DocStorage, peerId string) *leisure {
+	l := &leisure{
+		LeisureService: sv,
+		Monitors:       make(map[string]*docMonitor),
+		store:          store,
+		storage:        storage,
+		stopped:        make(chan bool),
+		peerId:         peerId,
+		metrics:        newPeerMetrics(),
+		replicators:    map[string]*replicator{},
+		members:        documentMembers{},
+		regions:        documentRegions{},
+		comments:       documentComments{},
+		markers:        documentMarkers{},
+		markerSessions: map[string]*markerSession{},
+		tags:           documentTags{},
+		forks:          documentForks{},
+		deleted:        deletedDocuments{},
+		index:          newSearchIndex(),
+	}
+	if store != nil {
+		l.members = store.meta.Members
+		l.regions = store.meta.Regions
+		l.comments = store.meta.Comments
+		l.markers = store.meta.Markers
+		l.tags = store.tags
+		l.forks = store.meta.Forks
+		l.deleted = store.meta.Deleted
+	}
+	return l
+}
+
+// add a document from inside the service and notify the listeners that live in this package
+func (l *leisure) addDocument(id, alias, content string) *history.History {
+	h := history.NewHistory(l.storage(id, content), content)
+	if alias != "" {
+		l.registerDocument(id, h, alias)
+	} else {
+		l.registerDocument(id, h)
+	}
+	return h
+}
+
+// registerDocument adds a document whose history is already built, like an imported one
+func (l *leisure) registerDocument(id string, h *history.History, aliases ...string) {
+	l.Documents[id] = h
+	for _, alias := range aliases {
+		l.DocumentAliases[alias] = id
+	}
+	if l.store != nil {
+		l.store.NewDocument(l.LeisureService, id)
+	}
+	l.NewDocument(l.LeisureService, id)
+}
+
 func (l *leisure) initMonitor(mux *http.ServeMux, monStr string, tlsConf *tls.Config, verbose int) {
 	m, err := monitor.New(monStr, verbose, tlsConf)
 	if err != nil {
@@ -663,7 +869,6 @@ func (l *leisure) initMonitor(mux *http.ServeMux, monStr string, tlsConf *tls.Co
 	}
 	l.Monitoring = m
 	m.InitMux(mux)
-	l.AddListener(l)
 }
 
 func writeProp(w io.Writer, prop string, v any) {
@@ -757,14 +962,23 @@ func (dm *docMonitor) writeBlock(w io.Writer, m map[string]any, oldChunk org.Chu
 	return nil
 }
 
-// if leisure is monitoring, make a "MONITOR-"+ID session for each new document
+// a new document clears its id's tombstone, gets indexed for search and, if leisure is
+// monitoring, gets a "MONITOR-"+ID session
 func (l *leisure) NewDocument(sv *server.LeisureService, id string) {
+	if l.deleted[id] != nil {
+		delete(l.deleted, id)
+		if l.store != nil {
+			l.store.saveMeta()
+		}
+	}
+	l.indexDocument(id)
 	if l.Monitoring == nil {
 		return
 	} else if rm, err := l.Monitoring.Add(id); err != nil {
 		panic(err)
 	} else {
-		l.verbose(1, "CREATED DOCUMENT, MONITORING SESSION MONITOR-"+id)
+		mlog := logFor(LOG_MONITOR).With("document", id, "session", "MONITOR-"+id)
+		mlog.Debug("created document, monitoring")
 		name := ""
 		for alias, docId := range sv.DocumentAliases {
 			if docId == id {
@@ -783,9 +997,10 @@ func (l *leisure) NewDocument(sv *server.LeisureService, id string) {
 			LeisureSession: updates,
 			lastUpdate:     0,
 			blockSerials:   make(map[org.OrgId]string),
+			logger:         mlog,
 		}
 		if wantsOrg {
-			l.verbose(1, "NEW DOCUMENT: "+name+" MONITOR-"+id)
+			mlog.Debug("new org document", "alias", name)
 			updates.ExclusiveDoc = updates.GetLatestDocument()
 			updates.Chunks = org.Parse(updates.ExclusiveDoc.String())
 			updates.ExternalFmt = dm.writeBlock
@@ -799,17 +1014,17 @@ func (l *leisure) NewDocument(sv *server.LeisureService, id string) {
 		blocks := make([]map[string]any, 0, updates.Chunks.Chunks.Measure().Count)
 		count := 0
 		for ch := range updates.Chunks.Seq() {
-			l.verbose(1, "BLOCK %#v", ch)
+			trace(mlog, "block", "chunk", dump{ch})
 			count++
 			if bl := dm.dataBlockFor(org.ChunkRef{Chunk: ch, OrgChunks: updates.Chunks}); bl != nil {
 				blocks = append(blocks, bl)
 			}
 		}
 		if len(blocks) > 0 {
-			l.verbose(1, "SENDING %d BLOCKS", len(blocks))
-			dm.BasicPatch(true, false, blocks...)
+			mlog.Debug("sending blocks", "count", len(blocks))
+			dm.sendBlocks(blocks...)
 		} else {
-			l.verbose(1, "NO BLOCKS FOUND OUT OF %d", count)
+			mlog.Debug("no blocks found", "chunks", count)
 		}
 		rm.ComputeTopics()
 	}
@@ -848,7 +1063,8 @@ func (dm *docMonitor) DataChanged(rm *monitor.RemoteMonitor) {
 }
 
 func (dm *docMonitor) DocumentChanged(s *server.LeisureSession, ch *org.ChunkChanges, removed map[org.OrgId]org.Chunk) {
-	dm.verbose(1, "@@@ RECEIVED DOCUMENT CHANGED\n  add    %v\n  remove %v\n  change %v\n @@@", ch.Added, ch.Removed, ch.Changed)
+	dm.logger.Debug("received document changed", "added", len(ch.Added), "removed", len(ch.Removed), "changed", len(ch.Changed))
+	trace(dm.logger, "document changes", "added", dump{ch.Added}, "removed", dump{ch.Removed}, "changed", dump{ch.Changed})
 	blockIds := make(u.Set[org.OrgId], len(ch.Added)+len(ch.Changed)+len(ch.Removed))
 	blocks := make([]map[string]any, 0, len(ch.Added)+len(ch.Changed)+len(ch.Removed))
 	for _, id := range ch.Removed {
@@ -867,28 +1083,35 @@ func (dm *docMonitor) DocumentChanged(s *server.LeisureSession, ch *org.ChunkCha
 			continue
 		}
 		chunk := s.ChunkRef(id)
-		dm.verbose(1, "Check block %s: %#v", id, chunk.Chunk)
+		trace(dm.logger, "check block", "block", id, "chunk", dump{chunk.Chunk})
 		if src, isSrc := chunk.Chunk.(*org.SourceBlock); isSrc {
 			if sends := src.GetOption("send"); sends != nil {
 				send := strings.Join(sends, " ")
 				old, has := dm.blockSerials[id]
 				if !has || old != send {
-					dm.verbose(1, "sending change, old serial: %v, new serial: %v", old, send)
+					dm.logger.Debug("sending change", "block", id, "oldSerial", old, "newSerial", send)
 					blockIds.Add(id)
 					blocks = append(blocks, dm.dataBlockFor(s.ChunkRef(id)))
 					dm.blockSerials[id] = send
 				} else {
-					dm.verbose(1, "ignoring change, old serial: %v, new serial: %v\n  opts: %v\n  send: %v\n  block: %#v", old, send, src.GetOptions(), src.GetOption("send"), src)
+					trace(dm.logger, "ignoring change", "block", id, "oldSerial", old, "newSerial", send, "options", dump{src.GetOptions()}, "chunk", dump{src})
 				}
 			}
 		}
 	}
 	if len(blocks) > 0 {
-		dm.verbose(1, "@@@  SEND: %v", blocks)
-		dm.BasicPatch(true, false, blocks...)
+		dm.logger.Debug("sending changed blocks", "count", len(blocks))
+		trace(dm.logger, "changed blocks", "blocks", dump{blocks})
+		dm.sendBlocks(blocks...)
 	}
 }
 
+// send blocks to REDIS
+func (dm *docMonitor) sendBlocks(blocks ...map[string]any) {
+	dm.stats.blocksSent.Add(int64(len(blocks)))
+	dm.BasicPatch(true, false, blocks...)
+}
+
 func (dm *docMonitor) updateSession() {
 	// merge the session doc, check changes, send to REDIS
 	if changes, err := dm.SessionEdit([]history.Replacement{}, -1, -1); err != nil {
@@ -925,14 +1148,14 @@ func (dm *docMonitor) updateSessionFromChanges(changes map[string]any) {
 				}
 			}
 		}
-		dm.BasicPatch(true, false, patch...)
+		dm.sendBlocks(patch...)
 	}
 }
 
 func (dm *docMonitor) dataBlockFor(chunk org.ChunkRef) map[string]any {
 	name := org.Name(chunk.Chunk)
 	if name == "" {
-		dm.verbose(1, "NO NAME FOR BLOCK %#v", chunk.Chunk)
+		trace(dm.logger, "no name for block", "chunk", dump{chunk.Chunk})
 		return nil
 	}
 	var opts map[string]string
@@ -949,11 +1172,11 @@ func (dm *docMonitor) dataBlockFor(chunk org.ChunkRef) map[string]any {
 		sblock = oblk
 		block["value"] = oblk.Value
 		if oblk.Value == nil {
-			lead := "\n  "
-			dm.verbose(1, "NO VALUE FOR BLOCK:%s%s", lead, strings.ReplaceAll(oblk.Text, "\n", lead))
+			dm.logger.Debug("no value for block", "name", name)
+			trace(dm.logger, "block text", "name", name, "text", oblk.Text)
 		}
 		opts = oblk.GetFullOptions(chunk.OrgChunks)
-		dm.verbose(1, "SOURCE BLOCK OPTIONS: %#v", opts)
+		trace(dm.logger, "source block options", "name", name, "options", dump{opts})
 	default:
 		return nil
 	}
@@ -970,10 +1193,11 @@ func (dm *docMonitor) dataBlockFor(chunk org.ChunkRef) map[string]any {
 		delete(dm.Blocks, name)
 		copyOpts(opts, block)
 	default:
-		dm.verbose(1, "Unknown block type, %v", opts["type"])
+		dm.logger.Debug("unknown block type", "name", name, "type", opts["type"])
 		return nil
 	}
-	dm.verbose(1, "\nFOUND BLOCK %s: %#v\n", name, block)
+	dm.logger.Debug("found block", "name", name, "type", opts["type"])
+	trace(dm.logger, "block", "name", name, "block", dump{block})
 	return block
 }
 
@@ -986,7 +1210,7 @@ func copyOpts(opts map[string]string, block map[string]any) { //, props ...strin
 }
 
 func sharedDataChanged(dm *docMonitor, rm *monitor.RemoteMonitor) {
-	dm.verbose(1, "PROCESSING CHANGED DATA FOR SHARED SESSION: %s", dm.SessionId)
+	dm.logger.Debug("processing changed data for shared session")
 	activity := ""
 	defer func() {
 		if rerr := recover(); rerr != nil {
@@ -994,8 +1218,8 @@ func sharedDataChanged(dm *docMonitor, rm *monitor.RemoteMonitor) {
 			if !ok {
 				err = fmt.Errorf("%v", rerr)
 			}
-			fmt.Fprintf(os.Stderr, "Error %s: %v\n", activity, err)
-			debug.PrintStack()
+			dm.stats.errors.Add(1)
+			dm.logger.Error("monitor error", "activity", activity, "error", err, "stack", string(debug.Stack()))
 		}
 	}()
 	// update doc first
@@ -1010,6 +1234,8 @@ func sharedDataChanged(dm *docMonitor, rm *monitor.RemoteMonitor) {
 	if len(changes)+len(deletes) == 0 {
 		return
 	}
+	dm.stats.updatesReceived.Add(int64(len(changes) + len(deletes)))
+	dm.stats.lastReceived.Store(time.Now().Unix())
 	new := u.NewSet[string]()
 	names := make(map[org.OrgId]string)
 	pos := make(map[org.OrgId]int)
@@ -1038,6 +1264,7 @@ func sharedDataChanged(dm *docMonitor, rm *monitor.RemoteMonitor) {
 			LeisureService: dm.LeisureService,
 			Session:        dm.LeisureSession,
 		},
+		leisure: dm.leisure,
 	}
 	activity = "adding data"
 	// add new chunks to doc
@@ -1067,7 +1294,9 @@ func sharedDataChanged(dm *docMonitor, rm *monitor.RemoteMonitor) {
 			}
 		} else {
 			activity = "removing data"
-			lc.Session.Replace(pos[id], len(ch.AsOrgChunk().Text), "")
+			if _, err := lc.ReplaceText(-1, -1, pos[id], len(ch.AsOrgChunk().Text), "", false); err != nil {
+				panic(err)
+			}
 		}
 	}
 	var trackChanges org.ChunkChanges
@@ -1204,10 +1433,14 @@ func main() {
 	cli := CLI{}
 	initGlobalOpts(&cli)
 	ctx := kong.Parse(&cli)
-	cli.verbose(1, "MAIN")
 	cli.globals.ctx = ctx
+	cli.applyConfig()
+	if err := configureLogging(cli.globals.Verbose, cli.globals.LogLevel, cli.globals.LogFormat, cli.globals.LogFile); err != nil {
+		panicWith("%w", err)
+	}
+	trace(cli.log(), "main", "args", os.Args)
 	cli.check()
 	cli.defaults()
-	cli.verbose(1, "RUN")
+	trace(cli.log(), "run", "command", ctx.Command())
 	ctx.Run(&cli)
 }
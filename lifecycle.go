@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leisure-tools/server"
+)
+
+const (
+	DOC_DELETE  = server.VERSION + "/doc/delete/"
+	DOC_ALIASES = server.VERSION + "/doc/aliases/"
+	DOC_RENAME  = server.VERSION + "/doc/rename/"
+)
+
+var ErrUnknownAlias = server.NewLeisureError("unknownAlias")
+
+// deletion describes a deleted document
+type deletion struct {
+	Document string   `json:"document"`
+	Aliases  []string `json:"aliases"`
+	Sessions []string `json:"sessions"`
+	Comments []string `json:"comments,omitempty"` // deleted comment threads on the document
+}
+
+// tombstone keeps a deleted document from coming back from a linked peer or a watched file
+type tombstone struct {
+	Aliases []string  `json:"aliases,omitempty"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// deletedDocuments maps deleted documents to their tombstones, until a document with
+// the same id is created again
+type deletedDocuments map[string]*tombstone
+
+// deletedAlias reports whether an alias belonged to a deleted document and no
+// document has it now, called in the service goroutine
+func (l *leisure) deletedAlias(alias string) bool {
+	if l.DocumentAliases[alias] != "" {
+		return false
+	}
+	for _, t := range l.deleted {
+		if slices.Contains(t.Aliases, alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// aliasesFor lists a document's aliases, called in the service goroutine
+func (l *leisure) aliasesFor(docId string) []string {
+	aliases := []string{}
+	for alias, id := range l.DocumentAliases {
+		if id == docId {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// deleteDocument removes a document with its sessions, monitor, aliases, and everything else
+// kept for it, along with comment threads on it, called in the service goroutine
+func (l *leisure) deleteDocument(docId string) *deletion {
+	h := l.Documents[docId]
+	result := &deletion{Document: docId, Aliases: l.aliasesFor(docId), Sessions: []string{}}
+	for id, s := range l.Sessions {
+		if s.History != h {
+			continue
+		}
+		// wake long polls, their next request finds the session gone
+		s.HasUpdate = true
+		if s.Updates != nil {
+			updates := s.Updates
+			go func() { updates <- true }()
+		}
+		delete(l.Sessions, id)
+		result.Sessions = append(result.Sessions, id)
+	}
+	sort.Strings(result.Sessions)
+	for _, alias := range result.Aliases {
+		delete(l.DocumentAliases, alias)
+	}
+	if dm := l.Monitors[docId]; dm != nil {
+		dm.RemoveListener(dm)
+		dm.ComputeTopics()
+		delete(l.Monitors, docId)
+	}
+	delete(l.members, docId)
+	delete(l.regions, docId)
+	delete(l.markers, docId)
+	delete(l.markerSessions, docId)
+	delete(l.tags, docId)
+	delete(l.forks, docId)
+	delete(l.comments, docId)
+	l.index.removeDoc(docId)
+	delete(l.Documents, docId)
+	l.deleted[docId] = &tombstone{Aliases: result.Aliases, Deleted: time.Now().UTC()}
+	if l.store != nil {
+		l.store.removeDocument(docId)
+	}
+	for id, c := range l.comments {
+		if c.Target == docId && l.Documents[id] != nil {
+			l.deleteDocument(id)
+			result.Comments = append(result.Comments, id)
+		}
+	}
+	sort.Strings(result.Comments)
+	return result
+}
+
+// addAlias names a document, called in the service goroutine
+func (l *leisure) addAlias(docId, alias string) error {
+	if alias == "" {
+		return fmt.Errorf("%w: expected an alias", ErrBadCommand)
+	} else if id := l.DocumentAliases[alias]; id != "" && id != docId {
+		return fmt.Errorf("%w: there is already a document with alias %s", server.ErrDocumentAliasExists, alias)
+	} else if l.Documents[alias] != nil && alias != docId {
+		return fmt.Errorf("%w: there is already a document %s", server.ErrDocumentExists, alias)
+	}
+	l.DocumentAliases[alias] = docId
+	if l.store != nil {
+		l.store.saveMeta()
+	}
+	return nil
+}
+
+// removeAlias removes one of a document's aliases, called in the service goroutine
+func (l *leisure) removeAlias(docId, alias string) error {
+	if l.DocumentAliases[alias] != docId {
+		return fmt.Errorf("%w: document %s has no alias %s", ErrUnknownAlias, docId, alias)
+	}
+	delete(l.DocumentAliases, alias)
+	if l.store != nil {
+		l.store.saveMeta()
+	}
+	return nil
+}
+
+// asOwner runs a change to a document for its owners, called in the service goroutine
+func (l *leisure) asOwner(doc, user string, change func(docId string) error) (string, error) {
+	docId := l.docId(doc)
+	if docId == "" {
+		return "", fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, doc)
+	} else if role := l.roleFor(docId, user); !hasRole(role, ROLE_OWNER) {
+		return "", forbidden(user, role, docId, ROLE_OWNER)
+	}
+	return docId, change(docId)
+}
+
+// URL: DELETE /v1/doc/delete/DOC -- delete DOC and comment threads on it, owners only
+func (l *leisure) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	doc := unescape(strings.TrimPrefix(r.URL.Path, DOC_DELETE))
+	user := identity(r)
+	if r.Method != http.MethodDelete || doc == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected DELETE %sDOC", ErrBadCommand, DOC_DELETE))))
+		return
+	}
+	var result *deletion
+	var err error
+	l.sync(func() {
+		_, err = l.asOwner(doc, user, func(docId string) error {
+			result = l.deleteDocument(docId)
+			return nil
+		})
+	})
+	writeDocResult(w, result, err)
+}
+
+// URL: GET /v1/doc/aliases/ -- every alias and its document, for the documents the identity can view
+// URL: GET /v1/doc/aliases/DOC -- DOC's aliases
+// URL: POST /v1/doc/aliases/DOC -- body {"alias": ALIAS}, owners only
+// URL: DELETE /v1/doc/aliases/DOC/ALIAS -- owners only
+func (l *leisure) aliasesHandler(w http.ResponseWriter, r *http.Request) {
+	doc, alias, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, DOC_ALIASES), "/")
+	doc, alias = unescape(doc), unescape(alias)
+	user := identity(r)
+	var add struct {
+		Alias string `json:"alias"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&add); err != nil || add.Alias == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected {\"alias\": ALIAS}", ErrBadCommand))))
+			return
+		}
+	}
+	var result any
+	var err error
+	l.sync(func() {
+		var docId string
+		switch {
+		case doc == "" && r.Method == http.MethodGet:
+			// members-only documents are left out like in DOC_LIST
+			aliases := map[string]string{}
+			for alias, id := range l.DocumentAliases {
+				if hasRole(l.roleFor(id, user), ROLE_VIEWER) {
+					aliases[alias] = id
+				}
+			}
+			result = aliases
+			return
+		case r.Method == http.MethodPost:
+			docId, err = l.asOwner(doc, user, func(docId string) error { return l.addAlias(docId, add.Alias) })
+		case r.Method == http.MethodDelete:
+			docId, err = l.asOwner(doc, user, func(docId string) error { return l.removeAlias(docId, alias) })
+		default:
+			if docId = l.docId(doc); docId == "" {
+				err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, doc)
+			} else if role := l.roleFor(docId, user); !hasRole(role, ROLE_VIEWER) {
+				err = forbidden(user, role, docId, ROLE_VIEWER)
+			}
+		}
+		if err == nil {
+			result = map[string]any{"document": docId, "aliases": l.aliasesFor(docId)}
+		}
+	})
+	writeDocResult(w, result, err)
+}
+
+// URL: POST /v1/doc/rename/ALIAS -- body {"alias": NEW}, give ALIAS's document NEW in its place, owners only
+func (l *leisure) renameHandler(w http.ResponseWriter, r *http.Request) {
+	alias := unescape(strings.TrimPrefix(r.URL.Path, DOC_RENAME))
+	user := identity(r)
+	var rename struct {
+		Alias string `json:"alias"`
+	}
+	if r.Method != http.MethodPost || alias == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected POST %sALIAS", ErrBadCommand, DOC_RENAME))))
+		return
+	} else if err := json.NewDecoder(r.Body).Decode(&rename); err != nil || rename.Alias == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected {\"alias\": NEW}", ErrBadCommand))))
+		return
+	}
+	var result any
+	var err error
+	l.sync(func() {
+		docId := l.DocumentAliases[alias]
+		if docId == "" {
+			err = fmt.Errorf("%w: no alias %s", ErrUnknownAlias, alias)
+			return
+		}
+		_, err = l.asOwner(docId, user, func(docId string) error {
+			if err := l.addAlias(docId, rename.Alias); err != nil {
+				return err
+			} else if alias == rename.Alias {
+				return nil
+			}
+			return l.removeAlias(docId, alias)
+		})
+		if err == nil {
+			result = map[string]any{"document": docId, "aliases": l.aliasesFor(docId)}
+		}
+	})
+	writeDocResult(w, result, err)
+}
+
+func writeDocResult(w http.ResponseWriter, result any, err error) {
+	switch server.ErrorType(err) {
+	case "":
+		writeJSON(w, result)
+	case ErrForbidden.Type:
+		writeForbidden(w, err)
+	case server.ErrUnknownDocument.Type, ErrUnknownAlias.Type:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(server.ErrorJSON(err)))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+	}
+}
+
+func (cmd *DocDeleteCmd) Run(cli *CLI) error {
+	output(cli.request(http.MethodDelete, nil, DOC_DELETE, cmd.Doc))
+	return nil
+}
+
+func (cmd *DocRenameCmd) Run(cli *CLI) error {
+	body, _ := json.Marshal(map[string]string{"alias": cmd.New})
+	output(cli.request(http.MethodPost, bytes.NewReader(body), DOC_RENAME, cmd.Alias))
+	return nil
+}
+
+func (cmd *DocAliasListCmd) Run(cli *CLI) error {
+	if cmd.Doc == "" {
+		output(cli.get(DOC_ALIASES))
+	} else {
+		output(cli.get(DOC_ALIASES, cmd.Doc))
+	}
+	return nil
+}
+
+func (cmd *DocAliasAddCmd) Run(cli *CLI) error {
+	body, _ := json.Marshal(map[string]string{"alias": cmd.Alias})
+	output(cli.request(http.MethodPost, bytes.NewReader(body), DOC_ALIASES, cmd.Doc))
+	return nil
+}
+
+func (cmd *DocAliasRemoveCmd) Run(cli *CLI) error {
+	output(cli.request(http.MethodDelete, nil, DOC_ALIASES, cmd.Doc, cmd.Alias))
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/leisure-tools/server"
+)
+
+// logging subsystems, each with its own level
+const (
+	LOG_PEER    = "peer"
+	LOG_MONITOR = "monitor"
+	LOG_SESSION = "session"
+	LOG_CLI     = "cli"
+)
+
+// LevelTrace is for messages that dump whole blocks or documents
+const LevelTrace = slog.LevelDebug - 4
+
+var LOG_SUBSYSTEMS = []string{LOG_PEER, LOG_MONITOR, LOG_SESSION, LOG_CLI}
+var LOG_LEVELS = map[string]slog.Level{
+	"trace": LevelTrace,
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+var ErrLogging = server.NewLeisureError("loggingFailure")
+
+var logLevels = map[string]*slog.LevelVar{}
+var logOutput slog.Handler = newLogHandler(os.Stderr, "logfmt")
+
+func init() {
+	for _, sub := range LOG_SUBSYSTEMS {
+		logLevels[sub] = &slog.LevelVar{}
+	}
+}
+
+// levelHandler filters a shared handler with a subsystem's level
+type levelHandler struct {
+	slog.Handler
+	level *slog.LevelVar
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.Handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{h.Handler.WithAttrs(attrs), h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{h.Handler.WithGroup(name), h.level}
+}
+
+// dump defers formatting a value with %#v until a trace message is actually written
+type dump struct{ value any }
+
+func (d dump) LogValue() slog.Value {
+	return slog.StringValue(fmt.Sprintf("%#v", d.value))
+}
+
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level: LevelTrace,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey {
+				if level, ok := a.Value.Any().(slog.Level); ok && level <= LevelTrace {
+					a.Value = slog.StringValue("TRACE")
+				}
+			}
+			return a
+		},
+	}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// logFor returns a logger for a subsystem; get loggers after configureLogging
+func logFor(subsystem string) *slog.Logger {
+	level := logLevels[subsystem]
+	if level == nil {
+		level = logLevels[LOG_PEER]
+	}
+	return slog.New(&levelHandler{
+		Handler: logOutput.WithAttrs([]slog.Attr{slog.String("subsystem", subsystem)}),
+		level:   level,
+	})
+}
+
+func trace(logger *slog.Logger, msg string, args ...any) {
+	logger.Log(context.Background(), LevelTrace, msg, args...)
+}
+
+// verbosityFor translates a subsystem's level for packages that take a verbose count
+func verbosityFor(subsystem string) int {
+	switch level := logLevels[subsystem].Level(); {
+	case level <= LevelTrace:
+		return 2
+	case level <= slog.LevelDebug:
+		return 1
+	}
+	return 0
+}
+
+// configureLogging sets the output and levels. -v counts set the default level,
+// specs are LEVEL for every subsystem or SUBSYSTEM=LEVEL.
+// A log file also receives error output from other packages.
+func configureLogging(verbose int, specs []string, format, file string) error {
+	defaultLevel := slog.LevelInfo
+	if verbose == 1 {
+		defaultLevel = slog.LevelDebug
+	} else if verbose > 1 {
+		defaultLevel = LevelTrace
+	}
+	for _, sub := range LOG_SUBSYSTEMS {
+		logLevels[sub].Set(defaultLevel)
+	}
+	for _, spec := range specs {
+		sub, levelName, hasSub := strings.Cut(spec, "=")
+		if !hasSub {
+			levelName = sub
+		}
+		level, ok := LOG_LEVELS[strings.ToLower(levelName)]
+		if !ok {
+			return fmt.Errorf("%w: unknown log level %s", ErrLogging, levelName)
+		} else if !hasSub {
+			for _, sub := range LOG_SUBSYSTEMS {
+				logLevels[sub].Set(level)
+			}
+		} else if logLevels[sub] == nil {
+			return fmt.Errorf("%w: unknown log subsystem %s, expected one of %s", ErrLogging, sub, strings.Join(LOG_SUBSYSTEMS, ", "))
+		} else {
+			logLevels[sub].Set(level)
+		}
+	}
+	if format != "" && format != "logfmt" && format != "json" {
+		return fmt.Errorf("%w: unknown log format %s, expected logfmt or json", ErrLogging, format)
+	}
+	out := io.Writer(os.Stderr)
+	if file != "" {
+		if f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return fmt.Errorf("%w: could not open log file %s: %s", ErrLogging, file, err)
+		} else {
+			os.Stderr = f
+			out = f
+		}
+	}
+	logOutput = newLogHandler(out, format)
+	return nil
+}
+
+// logSessions sends the server package's output to the session logger. The server writes
+// verbose output and session errors to os.Stderr and errors to the log package's default
+// logger, so os.Stderr becomes a pipe whose lines are logged. Error lines are logged as
+// errors with the stack lines that follow them, the rest as debug.
+func logSessions() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("%w: could not capture session output: %s", ErrLogging, err)
+	}
+	logger := logFor(LOG_SESSION)
+	slog.SetDefault(logger)
+	os.Stderr = w
+	go func() {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		level := slog.LevelDebug
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.TrimSpace(line) == "" {
+				continue
+			} else if strings.HasPrefix(line, "Session error") || strings.HasPrefix(line, "Error:") {
+				level = slog.LevelError
+			} else if !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, "goroutine ") {
+				level = slog.LevelDebug
+			}
+			logger.Log(context.Background(), level, line)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/org"
+	"github.com/leisure-tools/server"
+)
+
+const (
+	DOC_MARKERS    = server.VERSION + "/doc/markers/"
+	MARKER_PREFIX  = "MARKER-"
+	MARKER_SESSION = "MARKERS-"
+)
+
+var ErrUnknownMarker = server.NewLeisureError("unknownMarker")
+
+// marker is an anchor in a document that moves with its text through every replacement
+// and merge. A marker with a chunk stays at that org chunk's start while the chunk exists.
+// Data is for clients, like a bookmark's label or an outline's folding state.
+type marker struct {
+	Id     string          `json:"id"`
+	Offset int             `json:"offset"`
+	Length int             `json:"length,omitempty"`
+	Chunk  org.OrgId       `json:"chunk,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// documentMarkers maps documents to their markers by id
+type documentMarkers map[string]map[string]*marker
+
+// markerSession follows a document's changes for its markers, its chunks keep
+// their ids as the document changes
+type markerSession struct {
+	session *server.LeisureSession
+	heads   []history.Sha
+}
+
+// mapOffset moves an offset through replacements in its coordinates. Inserts at the offset
+// only move it if after is true and an offset inside a replacement moves to its start or,
+// if after is true, its end.
+func mapOffset(offset int, repls []history.Replacement, after bool) int {
+	shift := 0
+	for _, repl := range repls {
+		end := repl.Offset + repl.Length
+		if end < offset || (end == offset && (repl.Length > 0 || after)) {
+			shift += len(repl.Text) - repl.Length
+		} else if repl.Offset < offset {
+			if after {
+				return repl.Offset + shift + len(repl.Text)
+			}
+			return repl.Offset + shift
+		} else {
+			break
+		}
+	}
+	return offset + shift
+}
+
+// transformRange moves a range through replacements, text inserted at its edges stays outside it
+func transformRange(offset, length int, repls []history.Replacement) (int, int) {
+	for _, repl := range repls {
+		if repl.Length < 0 {
+			// the whole document was replaced
+			return 0, 0
+		}
+	}
+	start := mapOffset(offset, repls, true)
+	end := mapOffset(offset+length, repls, false)
+	if end < start {
+		end = start
+	}
+	return start, end - start
+}
+
+// chunkOffset finds a chunk's offset
+func chunkOffset(chunks *org.OrgChunks, id org.OrgId) (int, bool) {
+	offset := 0
+	for ch := range chunks.Seq() {
+		if ch.AsOrgChunk().Id == id {
+			return offset, true
+		}
+		offset += len(ch.AsOrgChunk().Text)
+	}
+	return 0, false
+}
+
+// chunkAt finds the chunk containing an offset and the chunk's offset
+func chunkAt(chunks *org.OrgChunks, offset int) (org.OrgId, int) {
+	start := 0
+	var last org.OrgId
+	for ch := range chunks.Seq() {
+		end := start + len(ch.AsOrgChunk().Text)
+		last = ch.AsOrgChunk().Id
+		if offset < end {
+			return last, start
+		}
+		start = end
+	}
+	return last, start
+}
+
+// markerSession returns the document's marker session, starting it if needed.
+// Chunk ids are new in each session, so this reattaches chunk markers by their offsets.
+func (l *leisure) markerSession(docId string) (*markerSession, error) {
+	if ms := l.markerSessions[docId]; ms != nil {
+		return ms, nil
+	}
+	h := l.Documents[docId]
+	if h == nil {
+		return nil, fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, docId)
+	}
+	s := l.Sessions[MARKER_SESSION+docId]
+	if s == nil {
+		var err error
+		if s, err = l.AddSession(MARKER_SESSION+docId, h, true, false, false, 0); err != nil {
+			return nil, err
+		}
+	}
+	// markers are current when the session starts
+	if _, _, _, err := s.Commit(0, 0, &org.ChunkChanges{}); err != nil {
+		return nil, err
+	}
+	s.Chunks = org.Parse(s.LatestBlock().GetDocument(s.History).String())
+	for _, m := range l.markers[docId] {
+		if m.Chunk != "" {
+			m.Chunk, m.Offset = chunkAt(s.Chunks, m.Offset)
+		}
+	}
+	ms := &markerSession{session: s, heads: slices.Clone(h.LatestHashes())}
+	l.markerSessions[docId] = ms
+	return ms, nil
+}
+
+// followMarkers moves a document's markers through its changes since they last moved,
+// called in the service goroutine
+func (l *leisure) followMarkers(docId string) error {
+	ms, err := l.markerSession(docId)
+	if err != nil {
+		return err
+	}
+	h := l.Documents[docId]
+	if slices.Equal(ms.heads, h.LatestHashes()) {
+		return nil
+	}
+	repls, _, _, err := ms.session.Commit(0, 0, &org.ChunkChanges{})
+	if err != nil {
+		return err
+	}
+	ms.heads = slices.Clone(h.LatestHashes())
+	if len(repls) == 0 || len(l.markers[docId]) == 0 {
+		return nil
+	}
+	chunks := ms.session.Chunks
+	if text := ms.session.LatestBlock().GetDocument(h).String(); chunks.Chunks.Measure().Width != len(text) {
+		// the session did not track chunks for these changes
+		chunks = org.Parse(text)
+		ms.session.Chunks = chunks
+	}
+	for _, m := range l.markers[docId] {
+		m.Offset, m.Length = transformRange(m.Offset, m.Length, repls)
+		if m.Chunk == "" {
+			continue
+		} else if offset, ok := chunkOffset(chunks, m.Chunk); ok {
+			m.Offset = offset
+		} else {
+			// the chunk is gone, so follow the one that took its place
+			m.Chunk, m.Offset = chunkAt(chunks, m.Offset)
+		}
+	}
+	if l.store != nil {
+		l.store.saveMeta()
+	}
+	return nil
+}
+
+// followAllMarkers brings every marker up to date, as the peer stops
+func (l *leisure) followAllMarkers() {
+	for docId := range l.markers {
+		if l.Documents[docId] != nil {
+			if err := l.followMarkers(docId); err != nil {
+				logFor(LOG_PEER).Error("could not move markers", "document", docId, "error", err)
+			}
+		}
+	}
+}
+
+// addMarker adds or replaces a marker at an offset in the latest document or at a chunk,
+// called in the service goroutine
+func (l *leisure) addMarker(docId string, m *marker) (*marker, error) {
+	if err := l.followMarkers(docId); err != nil {
+		return nil, err
+	}
+	ms := l.markerSessions[docId]
+	if m.Chunk != "" {
+		offset, ok := chunkOffset(ms.session.Chunks, m.Chunk)
+		if !ok {
+			return nil, fmt.Errorf("%w: no chunk %s in document %s", ErrUnknownMarker, m.Chunk, docId)
+		}
+		m.Offset = offset
+	} else if size := ms.session.Chunks.Chunks.Measure().Width; m.Offset < 0 || m.Length < 0 || m.Offset+m.Length > size {
+		return nil, fmt.Errorf("%w: range %d-%d is outside document %s", ErrBadCommand, m.Offset, m.Offset+m.Length, docId)
+	}
+	if m.Id == "" {
+		key := make([]byte, 8)
+		rand.Read(key)
+		m.Id = MARKER_PREFIX + hex.EncodeToString(key)
+	}
+	if l.markers[docId] == nil {
+		l.markers[docId] = map[string]*marker{}
+	}
+	l.markers[docId][m.Id] = m
+	if l.store != nil {
+		l.store.saveMeta()
+	}
+	return m, nil
+}
+
+func (l *leisure) removeMarker(docId, id string) error {
+	if l.markers[docId][id] == nil {
+		return fmt.Errorf("%w: no marker %s in document %s", ErrUnknownMarker, id, docId)
+	}
+	delete(l.markers[docId], id)
+	if len(l.markers[docId]) == 0 {
+		delete(l.markers, docId)
+	}
+	if l.store != nil {
+		l.store.saveMeta()
+	}
+	return nil
+}
+
+// URL: GET /v1/doc/markers/DOC -- DOC's markers where they are now, ?chunk=ID for a chunk's markers
+// URL: GET /v1/doc/markers/DOC/ID -- one marker
+// URL: POST /v1/doc/markers/DOC -- body {"id": ID, "offset": N, "length": N, "chunk": CHUNK, "data": VALUE},
+// where the id is optional and the offset is in the latest document
+// URL: DELETE /v1/doc/markers/DOC/ID
+//
+// Viewers can read a document's markers and commenters can add and delete them, except
+// for comments' markers, which belong to their threads.
+func (l *leisure) markersHandler(w http.ResponseWriter, r *http.Request) {
+	doc, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, DOC_MARKERS), "/")
+	doc, id = unescape(doc), unescape(id)
+	user := identity(r)
+	m := &marker{}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected {\"offset\": N} or {\"chunk\": ID}", ErrBadCommand))))
+			return
+		}
+	}
+	var result any
+	var err error
+	l.sync(func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%w: %v", ErrBadCommand, p)
+			}
+		}()
+		docId := l.docId(doc)
+		needed := ROLE_VIEWER
+		if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+			needed = ROLE_COMMENTER
+		}
+		if docId == "" {
+			err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, doc)
+			return
+		} else if role := l.roleFor(docId, user); !hasRole(role, needed) {
+			err = forbidden(user, role, docId, needed)
+			return
+		} else if needed == ROLE_COMMENTER && (strings.HasPrefix(m.Id, COMMENT_PREFIX) || strings.HasPrefix(id, COMMENT_PREFIX)) {
+			err = fmt.Errorf("%w: markers starting with %s belong to comment threads", ErrForbidden, COMMENT_PREFIX)
+			return
+		} else if err = l.followMarkers(docId); err != nil {
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost:
+			result, err = l.addMarker(docId, m)
+		case r.Method == http.MethodDelete:
+			err = l.removeMarker(docId, id)
+			result = true
+		case id != "":
+			if m := l.markers[docId][id]; m == nil {
+				err = fmt.Errorf("%w: no marker %s in document %s", ErrUnknownMarker, id, docId)
+			} else {
+				result = m
+			}
+		default:
+			chunk := org.OrgId(r.URL.Query().Get("chunk"))
+			markers := []*marker{}
+			for _, m := range l.markers[docId] {
+				if chunk == "" || m.Chunk == chunk {
+					markers = append(markers, m)
+				}
+			}
+			sort.Slice(markers, func(i, j int) bool {
+				return markers[i].Offset < markers[j].Offset || (markers[i].Offset == markers[j].Offset && markers[i].Id < markers[j].Id)
+			})
+			result = markers
+		}
+	})
+	switch server.ErrorType(err) {
+	case "":
+		writeJSON(w, result)
+	case ErrForbidden.Type:
+		writeForbidden(w, err)
+	case ErrUnknownMarker.Type:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(server.ErrorJSON(err)))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+	}
+}
+
+func (cmd *DocMarkersListCmd) Run(cli *CLI) error {
+	path := DOC_MARKERS + url.PathEscape(cmd.Doc)
+	if cmd.Chunk != "" {
+		path += "?chunk=" + url.QueryEscape(cmd.Chunk)
+	}
+	output(cli.get(path))
+	return nil
+}
+
+func (cmd *DocMarkersGetCmd) Run(cli *CLI) error {
+	output(cli.get(DOC_MARKERS, cmd.Doc, cmd.Id))
+	return nil
+}
+
+func (cmd *DocMarkersAddCmd) Run(cli *CLI) error {
+	m := &marker{Id: cmd.Id, Offset: cmd.Offset, Length: cmd.Length, Chunk: org.OrgId(cmd.Chunk)}
+	if cmd.Data != "" {
+		if !json.Valid([]byte(cmd.Data)) {
+			panicWith("%w: --data must be JSON", ErrBadCommand)
+		}
+		m.Data = json.RawMessage(cmd.Data)
+	}
+	body, _ := json.Marshal(m)
+	output(cli.request(http.MethodPost, bytes.NewReader(body), DOC_MARKERS, cmd.Doc))
+	return nil
+}
+
+func (cmd *DocMarkersRemoveCmd) Run(cli *CLI) error {
+	output(cli.request(http.MethodDelete, nil, DOC_MARKERS, cmd.Doc, cmd.Id))
+	return nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/server"
+	"gopkg.in/yaml.v2"
+)
+
+const DOC_MEMBERS = server.VERSION + "/doc/members/"
+
+// roles, each can do everything the roles before it can
+const (
+	ROLE_VIEWER    = "viewer"
+	ROLE_COMMENTER = "commenter"
+	ROLE_EDITOR    = "editor"
+	ROLE_OWNER     = "owner"
+)
+
+var ROLE_RANKS = map[string]int{
+	ROLE_VIEWER:    1,
+	ROLE_COMMENTER: 2,
+	ROLE_EDITOR:    3,
+	ROLE_OWNER:     4,
+}
+
+var ErrForbidden = server.NewLeisureError("forbidden")
+var ErrUnknownRole = server.NewLeisureError("unknownRole")
+
+// documentMembers maps identities to roles for each document.
+// Documents without members are open to everyone, as before membership existed.
+type documentMembers map[string]map[string]string
+
+type identityKey struct{}
+type peerAccessKey struct{}
+
+// identity is who made a request: the user for a token in --users on TCP, or the
+// system user of the process on the other end of the UNIX socket
+func identity(r *http.Request) string {
+	user, _ := r.Context().Value(identityKey{}).(string)
+	return user
+}
+
+func withIdentity(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, user))
+}
+
+// hasPeerAccess reports whether a request came with the peer's --token or from the
+// peer's own system user on the UNIX socket, which linking and shutting down need
+func hasPeerAccess(r *http.Request) bool {
+	access, _ := r.Context().Value(peerAccessKey{}).(bool)
+	return access
+}
+
+func withPeerAccess(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), peerAccessKey{}, true))
+}
+
+// socketContext names a UNIX socket connection's identity after the system user that
+// made it, for http.Server.ConnContext
+func socketContext(ctx context.Context, conn net.Conn) context.Context {
+	uid, ok := socketPeerUid(conn)
+	if !ok {
+		return ctx
+	}
+	name := strconv.Itoa(uid)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	ctx = context.WithValue(ctx, identityKey{}, name)
+	if uid == os.Getuid() {
+		ctx = context.WithValue(ctx, peerAccessKey{}, true)
+	}
+	return ctx
+}
+
+// readUsers reads a YAML map of identities to tokens
+func readUsers(file string) (map[string]string, error) {
+	users := map[string]string{}
+	if file == "" {
+		return users, nil
+	} else if buf, err := os.ReadFile(file); err != nil {
+		return nil, fmt.Errorf("%w: could not read users file %s: %s", ErrUnauthorized, file, err)
+	} else if err := yaml.UnmarshalStrict(buf, &users); err != nil {
+		return nil, fmt.Errorf("%w: bad users file %s, expected NAME: TOKEN lines: %s", ErrUnauthorized, file, err)
+	}
+	for user, token := range users {
+		if token == "" {
+			return nil, fmt.Errorf("%w: no token for %s in users file %s", ErrUnauthorized, user, file)
+		}
+	}
+	return users, nil
+}
+
+// docId resolves an alias, called in the service goroutine
+func (l *leisure) docId(idOrAlias string) string {
+	if l.Documents[idOrAlias] != nil {
+		return idOrAlias
+	}
+	return l.DocumentAliases[idOrAlias]
+}
+
+// sessionDoc returns the id of a session's document, called in the service goroutine
+func (l *leisure) sessionDoc(sessionId string) string {
+	if s := l.Sessions[sessionId]; s != nil {
+		for id, h := range l.Documents {
+			if h == s.History {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// roleFor returns user's role for a document, called in the service goroutine
+func (l *leisure) roleFor(docId, user string) string {
+	if role, ok := l.commentRole(docId, user); ok {
+		return role
+	}
+	if members := l.members[docId]; len(members) > 0 {
+		return members[user]
+	}
+	return ROLE_OWNER
+}
+
+// membersOnly reports whether a document, or the document a comment document belongs
+// to, has members, called in the service goroutine
+func (l *leisure) membersOnly(docId string) bool {
+	if c := l.comments[docId]; c != nil {
+		docId = c.Target
+	}
+	return len(l.members[docId]) > 0
+}
+
+func hasRole(role, needed string) bool {
+	return ROLE_RANKS[role] >= ROLE_RANKS[needed]
+}
+
+func forbidden(user, role, docId, needed string) error {
+	if user == "" {
+		user = "an anonymous user"
+	}
+	if role == "" {
+		return fmt.Errorf("%w: %s is not a member of document %s", ErrForbidden, user, docId)
+	}
+	return fmt.Errorf("%w: %s is a %s of document %s, this needs %s", ErrForbidden, user, role, docId, needed)
+}
+
+func writeForbidden(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(server.ErrorJSON(err)))
+}
+
+// the session named in a request's session cookie
+func cookieSession(r *http.Request) string {
+	if cookie, err := r.Cookie("session"); err == nil {
+		id, _, _ := strings.Cut(cookie.Value, "=")
+		return id
+	}
+	return ""
+}
+
+// editReplacements reads an edit's replacements, leaving the body readable
+func editReplacements(r *http.Request) ([]history.Replacement, bool) {
+	buf, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(buf))
+	if err != nil {
+		return nil, false
+	}
+	var edit struct {
+		Replacements []history.Replacement `json:"replacements"`
+	}
+	return edit.Replacements, json.Unmarshal(buf, &edit) == nil
+}
+
+// accessGuard enforces document membership on the session and document handlers.
+// Viewers and commenters have read-only sessions: they can connect, fetch, and
+// receive updates but not edit or set data. Documents without members are open.
+// Edits are also checked against the document's locked regions.
+func (l *leisure) accessGuard(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		user := identity(r)
+		needed := ROLE_VIEWER
+		var err error
+		var resolve func() string
+		var check func(docId, role string) error
+		switch {
+		case p == SHUTDOWN, p == REPLICATE:
+			if !hasPeerAccess(r) {
+				writeForbidden(w, fmt.Errorf("%w: %s needs the peer's token or its system user on the UNIX socket", ErrForbidden, p))
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		case p == server.DOC_LIST:
+			// members-only documents are left out for everyone else
+			var docs [][]string
+			l.sync(func() { docs = l.viewableDocuments(user) })
+			writeJSON(w, docs)
+			return
+		case strings.HasPrefix(p, server.DOC_GET):
+			resolve = func() string { return l.docId(unescape(strings.TrimPrefix(p, server.DOC_GET))) }
+		case strings.HasPrefix(p, server.SESSION_CREATE):
+			_, doc, _ := strings.Cut(unescape(strings.TrimPrefix(p, server.SESSION_CREATE)), "/")
+			resolve = func() string { return l.docId(doc) }
+		case strings.HasPrefix(p, server.SESSION_CONNECT):
+			sessionId := unescape(strings.TrimPrefix(p, server.SESSION_CONNECT))
+			doc := r.URL.Query().Get("doc")
+			if r.Method == http.MethodPost {
+				// posted content may change the document
+				needed = ROLE_EDITOR
+			}
+			resolve = func() string {
+				if id := l.sessionDoc(sessionId); id != "" {
+					return id
+				}
+				return l.docId(doc)
+			}
+		case p == server.SESSION_EDIT:
+			repls, ok := editReplacements(r)
+			if !ok || len(repls) > 0 {
+				needed = ROLE_EDITOR
+			}
+			sessionId := cookieSession(r)
+			resolve = func() string { return l.sessionDoc(sessionId) }
+			check = func(docId, role string) error {
+				if hasPeerAccess(r) {
+					// replicated edits were checked on the peer where they were made
+					return nil
+				}
+				return l.checkSessionRegions(docId, sessionId, user, role, repls)
+			}
+		case strings.HasPrefix(p, server.SESSION_SET), strings.HasPrefix(p, server.SESSION_REMOVE):
+			needed = ROLE_EDITOR
+			sessionId := cookieSession(r)
+			name := unescape(p[strings.LastIndex(p, "/")+1:])
+			resolve = func() string { return l.sessionDoc(sessionId) }
+			check = func(docId, role string) error {
+				return l.checkBlockRegions(docId, sessionId, user, role, name)
+			}
+		case p == server.SESSION_DOCUMENT, p == server.SESSION_UPDATE, p == SESSION_STREAM,
+			strings.HasPrefix(p, server.SESSION_GET), strings.HasPrefix(p, server.SESSION_TAG):
+			resolve = func() string { return l.sessionDoc(cookieSession(r)) }
+		default:
+			handler.ServeHTTP(w, r)
+			return
+		}
+		l.sync(func() {
+			// unknown documents and sessions are left for the handlers to report
+			if docId := resolve(); docId != "" {
+				if role := l.roleFor(docId, user); !hasRole(role, needed) {
+					err = forbidden(user, role, docId, needed)
+				} else if check != nil {
+					err = check(docId, role)
+				}
+			}
+		})
+		if err != nil {
+			writeForbidden(w, err)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// viewableDocuments lists the documents the identity can view like DOC_LIST does, as
+// [ID, ALIAS] pairs, called in the service goroutine
+func (l *leisure) viewableDocuments(user string) [][]string {
+	aliases := map[string]string{}
+	for alias, docId := range l.DocumentAliases {
+		aliases[docId] = alias
+	}
+	docs := [][]string{}
+	for docId := range l.Documents {
+		if hasRole(l.roleFor(docId, user), ROLE_VIEWER) {
+			docs = append(docs, []string{docId, aliases[docId]})
+		}
+	}
+	return docs
+}
+
+func unescape(escaped string) string {
+	if p, err := url.PathUnescape(escaped); err == nil {
+		return p
+	}
+	return escaped
+}
+
+// changeMember sets or, with an empty role, removes a member, called in the service goroutine.
+// Adding the first member to an open document makes the identity making the change its owner.
+func (l *leisure) changeMember(docId, user, member, role string) error {
+	if role != "" && ROLE_RANKS[role] == 0 {
+		return fmt.Errorf("%w: unknown role %s, expected viewer, commenter, editor, or owner", ErrUnknownRole, role)
+	} else if current := l.roleFor(docId, user); current != ROLE_OWNER {
+		return forbidden(user, current, docId, ROLE_OWNER)
+	}
+	members := map[string]string{}
+	for m, r := range l.members[docId] {
+		members[m] = r
+	}
+	if len(members) == 0 && role != "" && user != "" {
+		members[user] = ROLE_OWNER
+	}
+	if role == "" {
+		delete(members, member)
+	} else {
+		members[member] = role
+	}
+	hasOwner := false
+	for _, r := range members {
+		hasOwner = hasOwner || r == ROLE_OWNER
+	}
+	if len(members) > 0 && !hasOwner {
+		return fmt.Errorf("%w: document %s would have no owner", ErrForbidden, docId)
+	}
+	if len(members) == 0 {
+		delete(l.members, docId)
+	} else {
+		l.members[docId] = members
+	}
+	if l.store != nil {
+		l.store.saveMeta()
+	}
+	return nil
+}
+
+// URL: GET /v1/doc/members/DOC -- list a document's members, membersOnly is also true for comments on a members-only document
+// URL: POST /v1/doc/members/DOC -- body {"identity": NAME, "role": ROLE}, owners only
+// URL: DELETE /v1/doc/members/DOC/NAME -- owners only
+func (l *leisure) membersHandler(w http.ResponseWriter, r *http.Request) {
+	doc, member, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, DOC_MEMBERS), "/")
+	doc, member = unescape(doc), unescape(member)
+	user := identity(r)
+	var change struct {
+		Identity string `json:"identity"`
+		Role     string `json:"role"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil || change.Identity == "" || change.Role == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected {\"identity\": NAME, \"role\": ROLE}", ErrBadCommand))))
+			return
+		}
+	} else if r.Method == http.MethodDelete {
+		change.Identity = member
+	}
+	var result any
+	var err error
+	l.sync(func() {
+		docId := l.docId(doc)
+		if docId == "" {
+			err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, doc)
+			return
+		}
+		switch r.Method {
+		case http.MethodPost, http.MethodDelete:
+			if err = l.changeMember(docId, user, change.Identity, change.Role); err != nil {
+				return
+			}
+		default:
+			if role := l.roleFor(docId, user); !hasRole(role, ROLE_VIEWER) {
+				err = forbidden(user, role, docId, ROLE_VIEWER)
+				return
+			}
+		}
+		members := map[string]string{}
+		for m, role := range l.members[docId] {
+			members[m] = role
+		}
+		result = map[string]any{"document": docId, "members": members, "membersOnly": l.membersOnly(docId)}
+	})
+	if server.ErrorType(err) == ErrForbidden.Type {
+		writeForbidden(w, err)
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+	} else {
+		writeJSON(w, result)
+	}
+}
+
+func (cmd *DocMembersListCmd) Run(cli *CLI) error {
+	output(cli.get(DOC_MEMBERS, cmd.Doc))
+	return nil
+}
+
+func (cmd *DocMembersSetCmd) Run(cli *CLI) error {
+	if ROLE_RANKS[cmd.Role] == 0 {
+		names := make([]string, 0, len(ROLE_RANKS))
+		for role := range ROLE_RANKS {
+			names = append(names, role)
+		}
+		sort.Slice(names, func(i, j int) bool { return ROLE_RANKS[names[i]] < ROLE_RANKS[names[j]] })
+		panicWith("%w: unknown role %s, expected one of %s", ErrUnknownRole, cmd.Role, strings.Join(names, ", "))
+	}
+	body, _ := json.Marshal(map[string]string{"identity": cmd.Identity, "role": cmd.Role})
+	output(cli.request(http.MethodPost, bytes.NewReader(body), DOC_MEMBERS, cmd.Doc))
+	return nil
+}
+
+func (cmd *DocMembersRemoveCmd) Run(cli *CLI) error {
+	output(cli.request(http.MethodDelete, nil, DOC_MEMBERS, cmd.Doc, cmd.Identity))
+	return nil
+}
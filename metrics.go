@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leisure-tools/server"
+)
+
+const METRICS_PATH = "/metrics"
+
+// request duration buckets in seconds, long enough for SESSION_UPDATE's long polls
+var LATENCY_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// routes the metrics distinguish, everything else counts as "other"
+var METRIC_ROUTES = []string{
+	server.DOC_CREATE, server.DOC_GET, server.DOC_LIST,
+	server.SESSION_CLOSE, server.SESSION_CONNECT, server.SESSION_CREATE, server.SESSION_LIST,
+	server.SESSION_DOCUMENT, server.SESSION_EDIT, server.SESSION_UPDATE, server.SESSION_GET,
+	server.SESSION_SET, server.SESSION_TAG, server.ORG_PARSE, SESSION_STREAM, FILES_PATH,
+	COMMENTS, DOC_MARKERS, DOC_TAGS, DOC_LOG, DOC_DIFF, DOC_FORK, DOC_MERGE,
+	DOC_EXPORT, DOC_IMPORT, DOC_COMPACT, DOC_DELETE, DOC_ALIASES, DOC_RENAME,
+	SEARCH, BLOCKS,
+}
+
+// peerMetrics collects request statistics for the /metrics endpoint.
+// Document, session, and monitor numbers are read when it is scraped.
+type peerMetrics struct {
+	lock   sync.Mutex
+	routes map[string]*routeMetrics
+}
+
+type routeMetrics struct {
+	requests int64
+	errors   int64
+	sum      float64
+	buckets  []int64 // cumulative counts for LATENCY_BUCKETS
+}
+
+// counters for a docMonitor, updated from monitor goroutines
+type monitorMetrics struct {
+	blocksSent      atomic.Int64
+	updatesReceived atomic.Int64
+	errors          atomic.Int64
+	lastReceived    atomic.Int64 // unix seconds
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func newPeerMetrics() *peerMetrics {
+	return &peerMetrics{routes: map[string]*routeMetrics{}}
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming responses through the instrumentation
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func routeName(p string) string {
+	if p == METRICS_PATH {
+		return p
+	}
+	for _, route := range METRIC_ROUTES {
+		if p == route || (strings.HasSuffix(route, "/") && strings.HasPrefix(p, route)) {
+			return strings.TrimPrefix(route, server.VERSION)
+		}
+	}
+	return "other"
+}
+
+// instrument counts requests, errors, and latencies per route
+func (m *peerMetrics) instrument(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(sw, r)
+		m.record(routeName(r.URL.Path), time.Since(start).Seconds(), sw.status >= http.StatusBadRequest)
+	})
+}
+
+func (m *peerMetrics) record(route string, seconds float64, failed bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rm := m.routes[route]
+	if rm == nil {
+		rm = &routeMetrics{buckets: make([]int64, len(LATENCY_BUCKETS))}
+		m.routes[route] = rm
+	}
+	rm.requests++
+	if failed {
+		rm.errors++
+	}
+	rm.sum += seconds
+	for i, le := range LATENCY_BUCKETS {
+		if seconds <= le {
+			rm.buckets[i]++
+		}
+	}
+}
+
+func metricLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// URL: GET /metrics
+// Prometheus text format
+func (l *leisure) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	sb := &strings.Builder{}
+	l.sync(func() {
+		aliases := map[string]string{}
+		for alias, id := range l.DocumentAliases {
+			aliases[id] = alias
+		}
+		ids := make([]string, 0, len(l.Documents))
+		for id := range l.Documents {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		writeMetricHeader(sb, "leisure_documents", "gauge", "Number of documents")
+		fmt.Fprintf(sb, "leisure_documents %d\n", len(l.Documents))
+		writeMetricHeader(sb, "leisure_sessions", "gauge", "Number of sessions")
+		fmt.Fprintf(sb, "leisure_sessions %d\n", len(l.Sessions))
+		writeMetricHeader(sb, "leisure_history_blocks", "gauge", "History blocks per document")
+		for _, id := range ids {
+			fmt.Fprintf(sb, "leisure_history_blocks{document=\"%s\",alias=\"%s\"} %d\n",
+				metricLabel(id), metricLabel(aliases[id]), len(l.Documents[id].Blocks))
+		}
+		if len(l.Monitors) == 0 {
+			return
+		}
+		writeMetricHeader(sb, "leisure_monitor_blocks_sent_total", "counter", "Blocks sent to REDIS with BasicPatch")
+		for _, id := range ids {
+			if dm := l.Monitors[id]; dm != nil {
+				fmt.Fprintf(sb, "leisure_monitor_blocks_sent_total{document=\"%s\"} %d\n", metricLabel(id), dm.stats.blocksSent.Load())
+			}
+		}
+		writeMetricHeader(sb, "leisure_monitor_updates_received_total", "counter", "Data changes received from REDIS")
+		for _, id := range ids {
+			if dm := l.Monitors[id]; dm != nil {
+				fmt.Fprintf(sb, "leisure_monitor_updates_received_total{document=\"%s\"} %d\n", metricLabel(id), dm.stats.updatesReceived.Load())
+			}
+		}
+		writeMetricHeader(sb, "leisure_monitor_errors_total", "counter", "Errors while processing monitored data")
+		for _, id := range ids {
+			if dm := l.Monitors[id]; dm != nil {
+				fmt.Fprintf(sb, "leisure_monitor_errors_total{document=\"%s\"} %d\n", metricLabel(id), dm.stats.errors.Load())
+			}
+		}
+		writeMetricHeader(sb, "leisure_monitor_last_update_seconds", "gauge", "Unix time of the last data change received from REDIS")
+		for _, id := range ids {
+			if dm := l.Monitors[id]; dm != nil {
+				fmt.Fprintf(sb, "leisure_monitor_last_update_seconds{document=\"%s\"} %d\n", metricLabel(id), dm.stats.lastReceived.Load())
+			}
+		}
+	})
+	l.metrics.write(sb)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, sb.String())
+}
+
+func (m *peerMetrics) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	routes := make([]string, 0, len(m.routes))
+	for route := range m.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	writeMetricHeader(w, "leisure_http_requests_total", "counter", "HTTP requests by route")
+	for _, route := range routes {
+		fmt.Fprintf(w, "leisure_http_requests_total{route=\"%s\"} %d\n", route, m.routes[route].requests)
+	}
+	writeMetricHeader(w, "leisure_http_request_errors_total", "counter", "HTTP requests that returned an error status")
+	for _, route := range routes {
+		fmt.Fprintf(w, "leisure_http_request_errors_total{route=\"%s\"} %d\n", route, m.routes[route].errors)
+	}
+	writeMetricHeader(w, "leisure_http_request_duration_seconds", "histogram", "HTTP request latency by route")
+	for _, route := range routes {
+		rm := m.routes[route]
+		for i, le := range LATENCY_BUCKETS {
+			fmt.Fprintf(w, "leisure_http_request_duration_seconds_bucket{route=\"%s\",le=\"%g\"} %d\n", route, le, rm.buckets[i])
+		}
+		fmt.Fprintf(w, "leisure_http_request_duration_seconds_bucket{route=\"%s\",le=\"+Inf\"} %d\n", route, rm.requests)
+		fmt.Fprintf(w, "leisure_http_request_duration_seconds_sum{route=\"%s\"} %g\n", route, rm.sum)
+		fmt.Fprintf(w, "leisure_http_request_duration_seconds_count{route=\"%s\"} %d\n", route, rm.requests)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/org"
+	"github.com/leisure-tools/server"
+)
+
+const DOC_REGIONS = server.VERSION + "/doc/regions/"
+
+// region kinds, lock ids are KIND:NAME
+const (
+	REGION_BLOCK    = "block"
+	REGION_HEADLINE = "headline"
+)
+
+var ErrProtectedRegion = server.NewLeisureError("protectedRegion")
+
+// regionLock protects a named block or a headline's subtree so that only identities
+// with at least its role or listed in it can change it. Clients choose their session
+// names, so listed sessions only let the peer's own monitors through.
+//
+// Unlocking a region keeps it as a removed lock so that replication can tell the other
+// peer, the later change to a lock wins.
+type regionLock struct {
+	Id         string    `json:"id"`
+	Role       string    `json:"role"`
+	Identities []string  `json:"identities,omitempty"`
+	Sessions   []string  `json:"sessions,omitempty"` // monitor sessions
+	Changed    time.Time `json:"changed"`
+	Removed    bool      `json:"removed,omitempty"`
+}
+
+// documentRegions maps documents to their locks
+type documentRegions map[string][]*regionLock
+
+func regionId(kind, name string) string {
+	return kind + ":" + name
+}
+
+// newer is true if lock should replace old
+func (lock *regionLock) newer(old *regionLock) bool {
+	return old == nil || old.Changed.Before(lock.Changed)
+}
+
+// liveRegions leaves out removed locks
+func liveRegions(locks []*regionLock) []*regionLock {
+	return slices.DeleteFunc(slices.Clone(locks), func(lock *regionLock) bool { return lock.Removed })
+}
+
+func (lock *regionLock) kind() (string, string) {
+	kind, name, _ := strings.Cut(lock.Id, ":")
+	return kind, name
+}
+
+// allows a client's identity and role, or a monitor, which has no identity
+func (lock *regionLock) allows(user, role, monitor string) bool {
+	return hasRole(role, lock.Role) ||
+		(user != "" && slices.Contains(lock.Identities, user)) ||
+		(monitor != "" && slices.Contains(lock.Sessions, monitor))
+}
+
+// bounds locates the region in chunks, a headline's subtree ends at the next headline at its level or above
+func (lock *regionLock) bounds(chunks *org.OrgChunks) (int, int, bool) {
+	kind, name := lock.kind()
+	switch kind {
+	case REGION_BLOCK:
+		if offset, ref := chunks.LocateChunkNamed(name); !ref.IsEmpty() {
+			return offset, offset + len(ref.AsOrgChunk().Text), true
+		}
+	case REGION_HEADLINE:
+		start, level, offset := -1, 0, 0
+		for ch := range chunks.Seq() {
+			if hl, ok := ch.(*org.Headline); ok {
+				if start != -1 && hl.Level <= level {
+					return start, offset, true
+				} else if start == -1 && strings.TrimSpace(strings.TrimLeft(hl.Text, "*")) == name {
+					start, level = offset, hl.Level
+				}
+			}
+			offset += len(ch.AsOrgChunk().Text)
+		}
+		if start != -1 {
+			return start, offset, true
+		}
+	}
+	return 0, 0, false
+}
+
+// touches is true if repl changes text inside start and end, inserting at either edge is allowed
+func touches(repl history.Replacement, start, end int) bool {
+	if repl.Length < 0 {
+		return true
+	} else if repl.Length == 0 {
+		return start < repl.Offset && repl.Offset < end
+	}
+	return repl.Offset < end && repl.Offset+repl.Length > start
+}
+
+// checkRegions rejects replacements in text's coordinates that touch a region locked against
+// the identity and role or the monitor session, called in the service goroutine
+func (l *leisure) checkRegions(docId, user, role, monitor, text string, repls []history.Replacement) error {
+	locks := l.regions[docId]
+	if len(locks) == 0 || len(repls) == 0 {
+		return nil
+	} else if len(l.members[docId]) == 0 {
+		// everyone owns an open document, so only the lock's identities and monitors may edit
+		role = ""
+	}
+	var chunks *org.OrgChunks
+	for _, lock := range locks {
+		if lock.Removed || lock.allows(user, role, monitor) {
+			continue
+		} else if chunks == nil {
+			chunks = org.Parse(text)
+		}
+		if start, end, ok := lock.bounds(chunks); ok {
+			for _, repl := range repls {
+				if touches(repl, start, end) {
+					return fmt.Errorf("%w: %s in document %s is locked, it needs %s", ErrProtectedRegion, lock.Id, docId, lock.Role)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkSessionRegions checks a client's replacements against the document as its session last saw it
+func (l *leisure) checkSessionRegions(docId, sessionId, user, role string, repls []history.Replacement) error {
+	s := l.Sessions[sessionId]
+	if s == nil || len(l.regions[docId]) == 0 {
+		return nil
+	}
+	return l.checkRegions(docId, user, role, "", sessionText(s), repls)
+}
+
+// checkBlockRegions checks a client changing a named block, as setting or removing data does
+func (l *leisure) checkBlockRegions(docId, sessionId, user, role, name string) error {
+	s := l.Sessions[sessionId]
+	if s == nil || len(l.regions[docId]) == 0 {
+		return nil
+	}
+	text := sessionText(s)
+	if offset, ref := org.Parse(text).LocateChunkNamed(name); !ref.IsEmpty() {
+		repl := []history.Replacement{{Offset: offset, Length: len(ref.AsOrgChunk().Text)}}
+		return l.checkRegions(docId, user, role, "", text, repl)
+	}
+	return nil
+}
+
+// ReplaceText checks monitor edits against locked regions, monitors have no identity
+// or role so only locks that list their sessions let them through
+func (lc *lcontext) ReplaceText(selOff, selLen, offset, length int, text string, b bool) (map[string]any, error) {
+	sessionId := lc.Session.SessionId
+	if docId := lc.leisure.sessionDoc(sessionId); docId != "" && len(lc.leisure.regions[docId]) > 0 {
+		repl := []history.Replacement{{Offset: offset, Length: length, Text: text}}
+		if err := lc.leisure.checkRegions(docId, "", "", sessionId, sessionText(lc.Session), repl); err != nil {
+			return nil, err
+		}
+	}
+	return lc.LeisureContext.ReplaceText(selOff, selLen, offset, length, text, b)
+}
+
+func (l *leisure) saveRegions(docId string, locks []*regionLock) {
+	if len(locks) == 0 {
+		delete(l.regions, docId)
+	} else {
+		l.regions[docId] = locks
+	}
+	if l.store != nil {
+		l.store.saveMeta()
+	}
+}
+
+// URL: GET /v1/doc/regions/DOC -- list a document's locked regions
+// URL: GET /v1/doc/regions/DOC?removed=true -- include removed locks, as replication does
+// URL: POST /v1/doc/regions/DOC -- body {"id": "block:NAME" or "headline:TEXT", "role": ROLE, "identities": [NAME...], "sessions": [MONITOR...]}, owners only
+// URL: DELETE /v1/doc/regions/DOC/ID -- owners only
+//
+// Only requests with the peer's token can post a lock's "changed" time or "removed", as
+// replication does.
+func (l *leisure) regionsHandler(w http.ResponseWriter, r *http.Request) {
+	doc, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, DOC_REGIONS), "/")
+	doc, id = unescape(doc), unescape(id)
+	user := identity(r)
+	removed := r.URL.Query().Get("removed") == "true"
+	lock := &regionLock{}
+	if r.Method == http.MethodPost {
+		kind, name := "", ""
+		if err := json.NewDecoder(r.Body).Decode(lock); err == nil {
+			kind, name = lock.kind()
+		}
+		if (kind != REGION_BLOCK && kind != REGION_HEADLINE) || name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected {\"id\": \"block:NAME\" or \"headline:TEXT\", \"role\": ROLE}", ErrBadCommand))))
+			return
+		} else if (!lock.Changed.IsZero() || lock.Removed) && !hasPeerAccess(r) {
+			writeForbidden(w, fmt.Errorf("%w: only the peer's token can set a lock's changed time or remove it by posting", ErrForbidden))
+			return
+		}
+		setDefault(&lock.Role, ROLE_OWNER)
+		if lock.Changed.IsZero() {
+			lock.Changed = time.Now()
+		}
+	}
+	var result any
+	var err error
+	l.sync(func() {
+		docId := l.docId(doc)
+		if docId == "" {
+			err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, doc)
+			return
+		}
+		needed := ROLE_VIEWER
+		if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+			needed = ROLE_OWNER
+		}
+		if role := l.roleFor(docId, user); !hasRole(role, needed) {
+			err = forbidden(user, role, docId, needed)
+			return
+		}
+		locks := slices.Clone(l.regions[docId])
+		switch r.Method {
+		case http.MethodPost:
+			if ROLE_RANKS[lock.Role] == 0 {
+				err = fmt.Errorf("%w: unknown role %s, expected viewer, commenter, editor, or owner", ErrUnknownRole, lock.Role)
+				return
+			}
+			locks = slices.DeleteFunc(locks, func(old *regionLock) bool { return old.Id == lock.Id })
+			locks = append(locks, lock)
+			sort.Slice(locks, func(i, j int) bool { return locks[i].Id < locks[j].Id })
+			l.saveRegions(docId, locks)
+		case http.MethodDelete:
+			i := slices.IndexFunc(locks, func(old *regionLock) bool { return old.Id == id && !old.Removed })
+			if i == -1 {
+				err = fmt.Errorf("%w: no locked region %s in document %s", ErrProtectedRegion, id, docId)
+				return
+			}
+			locks[i] = &regionLock{Id: id, Role: locks[i].Role, Changed: time.Now(), Removed: true}
+			l.saveRegions(docId, locks)
+		}
+		if !removed {
+			locks = liveRegions(locks)
+		}
+		if locks == nil {
+			locks = []*regionLock{}
+		}
+		result = map[string]any{"document": docId, "regions": locks}
+	})
+	if server.ErrorType(err) == ErrForbidden.Type {
+		writeForbidden(w, err)
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+	} else {
+		writeJSON(w, result)
+	}
+}
+
+// syncRegions sends and fetches locked regions, including removed ones, the later change
+// to a lock winning
+func (r *replicator) syncRegions(rd *replicaDoc) error {
+	var remoteResult struct {
+		Regions []*regionLock `json:"regions"`
+	}
+	if err := r.call(rd.client, http.MethodGet, DOC_REGIONS+url.PathEscape(rd.docId)+"?removed=true", nil, &remoteResult); err != nil {
+		return err
+	}
+	remote := map[string]*regionLock{}
+	for _, lock := range remoteResult.Regions {
+		remote[lock.Id] = lock
+	}
+	var send []*regionLock
+	r.sync(func() {
+		locks := slices.Clone(r.regions[rd.docId])
+		local := map[string]*regionLock{}
+		for _, lock := range locks {
+			local[lock.Id] = lock
+			if lock.newer(remote[lock.Id]) {
+				send = append(send, lock)
+			}
+		}
+		fetched := false
+		for id, lock := range remote {
+			if lock.newer(local[id]) {
+				locks = slices.DeleteFunc(locks, func(old *regionLock) bool { return old.Id == id })
+				locks = append(locks, lock)
+				fetched = true
+				r.logger.Debug("received locked region", "document", rd.docId, "region", id, "removed", lock.Removed)
+			}
+		}
+		if fetched {
+			sort.Slice(locks, func(i, j int) bool { return locks[i].Id < locks[j].Id })
+			r.saveRegions(rd.docId, locks)
+		}
+	})
+	for _, lock := range send {
+		if err := r.call(rd.client, http.MethodPost, DOC_REGIONS+url.PathEscape(rd.docId), lock, nil); server.ErrorType(err) == ErrForbidden.Type {
+			// the link's token is not the remote peer's own
+			r.logger.Debug("remote refused locked region", "document", rd.docId, "region", lock.Id, "error", err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		r.logger.Debug("sent locked region", "document", rd.docId, "region", lock.Id, "removed", lock.Removed)
+	}
+	return nil
+}
+
+func (cmd *DocRegionsListCmd) Run(cli *CLI) error {
+	output(cli.get(DOC_REGIONS, cmd.Doc))
+	return nil
+}
+
+func (cmd *DocRegionsLockCmd) Run(cli *CLI) error {
+	id := ""
+	if cmd.Block != "" && cmd.Headline == "" {
+		id = regionId(REGION_BLOCK, cmd.Block)
+	} else if cmd.Headline != "" && cmd.Block == "" {
+		id = regionId(REGION_HEADLINE, cmd.Headline)
+	} else {
+		panicWith("%w: expected one of --block or --headline", ErrBadCommand)
+	}
+	body, _ := json.Marshal(&regionLock{Id: id, Role: cmd.Role, Identities: cmd.Identity, Sessions: cmd.Session})
+	output(cli.request(http.MethodPost, bytes.NewReader(body), DOC_REGIONS, cmd.Doc))
+	return nil
+}
+
+func (cmd *DocRegionsUnlockCmd) Run(cli *CLI) error {
+	output(cli.request(http.MethodDelete, nil, DOC_REGIONS, cmd.Doc, cmd.Id))
+	return nil
+}
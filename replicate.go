@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/org"
+	"github.com/leisure-tools/server"
+)
+
+const (
+	REPLICATE          = server.VERSION + "/peer/replicate"
+	REPLICATE_HELLO    = server.VERSION + "/peer/hello"
+	REPLICATE_INTERVAL = time.Second
+	REPLICATE_TIMEOUT  = 10 * time.Second
+	REPLICA_PREFIX     = "REPLICA-"
+)
+
+var ErrReplication = server.NewLeisureError("replicationFailure")
+var ErrLinkRefused = server.NewLeisureError("linkRefused")
+
+// replicator shares every document with another peer.
+//
+// Each document has a REPLICA-PEER-ID session on the remote peer, named after this
+// peer, and one on this peer named after the remote one. Every interval, local changes
+// go to the remote session as an edit and the remote's reply, which carries everyone
+// else's changes, is committed to the local session, so both histories merge the other
+// peer's edits like any session's. Tags and locked regions go along with the text, with
+// the newer tag or lock winning when both peers have one. Locks are enforced where
+// the edits are made, so the remote peer lets the link's edits through them when the
+// link has its token.
+//
+// The sessions' names stay the same across links and restarts, so the remote
+// session's view of the document is the last text both peers agreed on. Linking again
+// starts from that view, so edits either peer made while the link was down merge
+// instead of replacing each other.
+//
+// Peers exchange text edits through sessions, not history blocks, so each peer's
+// history records the other peer's changes as commits of its replica session rather
+// than as the original blocks with their authors and times. The history package only
+// adds blocks from its own commits and the server has no way to send or receive
+// blocks, so a peer cannot take in the other's blocks without changes there. Edits go
+// through the same session merge as every other editor's, so both peers still converge
+// on the same text, but their block hashes differ and a block from one peer means
+// nothing to the other.
+//
+// Members-only documents stay on their peers, which keep their members, so links leave
+// them out, stopping when a linked document gets members.
+//
+// A link carries changes both ways, so two peers only need one. A second link in the
+// other direction would commit each edit on both peers twice, so a peer refuses a link
+// from a peer it already links to.
+type replicator struct {
+	*leisure
+	url      *url.URL
+	token    string
+	client   *http.Client
+	peer     string // the remote peer's id, set in the service goroutine
+	linked   bool   // the remote peer accepted the link
+	logger   *slog.Logger
+	docs     map[string]*replicaDoc
+	jars     map[string]*cookiejar.Jar // the remote sessions' keys, kept when documents link again
+	private  map[string]bool           // members-only documents, left out
+	failures map[string]string         // link errors already logged
+	lock     sync.Mutex
+	status   replicaStatus
+}
+
+type replicaDoc struct {
+	docId   string
+	client  *http.Client // its cookie jar holds the remote session's key
+	session *server.LeisureSession
+	base    string // the remote session's view of the document
+	heads   []history.Sha
+}
+
+type replicaStatus struct {
+	Url       string    `json:"url"`
+	Peer      string    `json:"peer,omitempty"`
+	Documents int       `json:"documents"`
+	LastSync  time.Time `json:"lastSync,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+type replicaEdit struct {
+	Replacements    []history.Replacement `json:"replacements"`
+	SelectionOffset int                   `json:"selectionOffset"`
+	SelectionLength int                   `json:"selectionLength"`
+}
+
+// peerIdFor names a peer by its host and socket, which stay the same when it restarts
+func peerIdFor(socket string) string {
+	host, _ := os.Hostname()
+	if abs, err := filepath.Abs(socket); err == nil {
+		socket = abs
+	}
+	return shortHash(textHash(host + "\n" + socket))
+}
+
+// replicate starts replicating with the peer at urlStr, if it is not already, trusting
+// the peer's --replicate-ca-cert for TLS
+func (l *leisure) replicate(urlStr, token string) (*replicator, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: bad peer url %s, expected http://HOST:PORT or https://HOST:PORT", ErrReplication, urlStr)
+	}
+	u.Path = ""
+	r := &replicator{
+		leisure:  l,
+		url:      u,
+		token:    token,
+		logger:   logFor(LOG_PEER).With("replicate", u.String()),
+		docs:     map[string]*replicaDoc{},
+		jars:     map[string]*cookiejar.Jar{},
+		private:  map[string]bool{},
+		failures: map[string]string{},
+		status:   replicaStatus{Url: u.String()},
+	}
+	var tlsConfig *tls.Config
+	if u.Scheme == "https" {
+		if tlsConfig, err = tlsClientConfig(l.linkCaCert); err != nil {
+			return nil, err
+		}
+	}
+	r.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: REPLICATE_TIMEOUT}
+	exists := false
+	l.sync(func() {
+		if l.replicators[r.url.String()] != nil {
+			exists = true
+		} else {
+			l.replicators[r.url.String()] = r
+		}
+	})
+	if exists {
+		return nil, fmt.Errorf("%w: already replicating with %s", ErrReplication, r.url)
+	}
+	// the first hello reports a refusal to whoever asked for the link, the run loop
+	// retries when the remote peer is not answering yet
+	if err := r.hello(); server.ErrorType(err) == ErrLinkRefused.Type {
+		r.unlink()
+		return nil, err
+	} else if err != nil {
+		r.logger.Warn("could not reach peer, will keep trying", "error", err)
+	} else {
+		r.linked = true
+	}
+	r.logger.Info("replicating documents")
+	go r.run()
+	return r, nil
+}
+
+// hello learns the remote peer's id and asks it to accept the link. The id is recorded
+// before asking, so when two peers link to each other at the same time, at least one
+// of them finds the other's link and refuses.
+func (r *replicator) hello() error {
+	var remote struct {
+		Peer string `json:"peer"`
+	}
+	if err := r.call(r.client, http.MethodGet, REPLICATE_HELLO, nil, &remote); err != nil {
+		return err
+	} else if remote.Peer == "" {
+		return fmt.Errorf("%w: %s did not send its peer id", ErrReplication, r.url)
+	} else if remote.Peer == r.peerId {
+		return fmt.Errorf("%w: %s is this peer", ErrLinkRefused, r.url)
+	}
+	r.sync(func() { r.peer = remote.Peer })
+	r.lock.Lock()
+	r.status.Peer = remote.Peer
+	r.lock.Unlock()
+	return r.call(r.client, http.MethodPost, REPLICATE_HELLO, map[string]string{"peer": r.peerId}, nil)
+}
+
+// unlink stops replicating
+func (r *replicator) unlink() {
+	r.sync(func() {
+		if r.replicators[r.url.String()] == r {
+			delete(r.replicators, r.url.String())
+		}
+	})
+}
+
+func (r *replicator) run() {
+	for !r.stopping.Load() {
+		var err error
+		if !r.linked {
+			if err = r.hello(); server.ErrorType(err) == ErrLinkRefused.Type {
+				r.logger.Error("peer refused link", "error", err)
+				r.unlink()
+				return
+			}
+			r.linked = err == nil
+		}
+		if r.linked {
+			err = r.syncDocs()
+		}
+		r.lock.Lock()
+		r.status.Documents = len(r.docs)
+		if err != nil {
+			r.status.LastError = err.Error()
+		} else {
+			r.status.LastSync = time.Now()
+			r.status.LastError = ""
+		}
+		r.lock.Unlock()
+		time.Sleep(REPLICATE_INTERVAL)
+	}
+}
+
+func (r *replicator) getStatus() replicaStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.status
+}
+
+// syncDocs links new documents on either peer and exchanges changes for all of them
+func (r *replicator) syncDocs() error {
+	var remoteList [][]string
+	if err := r.call(r.client, http.MethodGet, server.DOC_LIST, nil, &remoteList); err != nil {
+		r.logger.Debug("could not list remote documents", "error", err)
+		// link again when the remote answers, it may have restarted
+		clear(r.docs)
+		return err
+	}
+	remote := map[string]string{}
+	for _, item := range remoteList {
+		if len(item) == 2 {
+			remote[item[0]] = item[1]
+		}
+	}
+	local := map[string]string{}
+	deleted := map[string]bool{}
+	r.sync(func() {
+		for id := range r.Documents {
+			local[id] = ""
+		}
+		for alias, id := range r.DocumentAliases {
+			if _, ok := local[id]; ok {
+				local[id] = alias
+			}
+		}
+		for id := range r.deleted {
+			deleted[id] = true
+		}
+	})
+	ids := make([]string, 0, len(local)+len(remote))
+	for id := range local {
+		ids = append(ids, id)
+	}
+	for id := range remote {
+		if _, ok := local[id]; !ok && !deleted[id] {
+			ids = append(ids, id)
+		}
+	}
+	for id := range r.docs {
+		if deleted[id] {
+			// deleted here, so stop replicating it instead of copying it back
+			delete(r.docs, id)
+		}
+	}
+	sort.Strings(ids)
+	var lastErr error
+	for _, id := range ids {
+		_, hasLocal := local[id]
+		_, hasRemote := remote[id]
+		if private, err := r.membersOnly(id, hasRemote); err != nil {
+			r.logger.Debug("could not check document members", "document", id, "error", err)
+			lastErr = err
+			continue
+		} else if private {
+			if !r.private[id] {
+				r.logger.Info("not replicating members-only document", "document", id)
+				r.private[id] = true
+			}
+			delete(r.docs, id)
+			continue
+		}
+		delete(r.private, id)
+		rd := r.docs[id]
+		if rd == nil {
+			var err error
+			if rd, err = r.link(id, local[id]+remote[id], hasLocal, hasRemote); err != nil {
+				if r.failures[id] != err.Error() {
+					r.logger.Error("could not link document", "document", id, "error", err)
+					r.failures[id] = err.Error()
+				}
+				lastErr = err
+				continue
+			}
+			delete(r.failures, id)
+			r.docs[id] = rd
+		}
+		err := r.syncDoc(rd)
+		if err == nil {
+			err = r.syncTags(rd)
+		}
+		if err == nil {
+			err = r.syncRegions(rd)
+		}
+		if err != nil {
+			// link again on the next pass, the remote may have restarted
+			r.logger.Error("could not replicate document", "document", id, "error", err)
+			delete(r.docs, id)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// membersOnly reports whether either peer limits a document to its members
+func (r *replicator) membersOnly(id string, hasRemote bool) (bool, error) {
+	private := false
+	r.sync(func() { private = r.leisure.membersOnly(id) })
+	if private || !hasRemote {
+		return private, nil
+	}
+	var remote struct {
+		MembersOnly bool `json:"membersOnly"`
+	}
+	if err := r.call(r.client, http.MethodGet, DOC_MEMBERS+url.PathEscape(id), nil, &remote); err != nil {
+		return false, err
+	}
+	return remote.MembersOnly, nil
+}
+
+// link a document, creating it on whichever peer does not have it yet. The remote
+// session's view becomes the base, so the first sync sends the local changes since the
+// peers last agreed and receives the remote's.
+func (r *replicator) link(id, alias string, hasLocal, hasRemote bool) (*replicaDoc, error) {
+	if r.jars[id] == nil {
+		r.jars[id], _ = cookiejar.New(nil)
+	}
+	rd := &replicaDoc{
+		docId:  id,
+		client: &http.Client{Jar: r.jars[id], Transport: r.client.Transport},
+	}
+	if !hasRemote {
+		var text string
+		r.sync(func() {
+			if h := r.Documents[id]; h != nil {
+				text = h.GetLatestDocument().String()
+			}
+		})
+		create := server.DOC_CREATE + url.PathEscape(id)
+		if alias != "" {
+			create += "?alias=" + url.QueryEscape(alias)
+		}
+		if err := r.call(rd.client, http.MethodPost, create, text, nil); err != nil {
+			return nil, err
+		}
+	}
+	// the session may be left from an earlier link, possibly with a key this peer lost
+	connect := server.SESSION_CONNECT + url.PathEscape(REPLICA_PREFIX+r.peerId+"-"+id) + "?doc=" + url.QueryEscape(id) + "&force=true"
+	if err := r.call(rd.client, http.MethodGet, connect, nil, nil); err != nil {
+		return nil, err
+	} else if err := r.call(rd.client, http.MethodGet, server.SESSION_DOCUMENT, nil, &rd.base); err != nil {
+		return nil, err
+	}
+	var err error
+	r.sync(func() {
+		h := r.Documents[id]
+		if !hasLocal && h == nil {
+			// the first sync brings any changes past the session's view
+			h = r.addDocument(id, alias, rd.base)
+		} else if h == nil {
+			err = fmt.Errorf("%w: document %s was removed", ErrReplication, id)
+			return
+		}
+		sessionId := REPLICA_PREFIX + r.peer + "-" + id
+		if rd.session = r.Sessions[sessionId]; rd.session == nil {
+			rd.session, err = r.AddSession(sessionId, h, false, true, false, 0)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Debug("linked document", "document", id, "alias", alias, "created", !hasLocal || !hasRemote)
+	return rd, nil
+}
+
+// syncDoc sends local changes to the remote session and commits the remote's changes locally
+func (r *replicator) syncDoc(rd *replicaDoc) (err error) {
+	var text string
+	r.sync(func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%w: %v", ErrReplication, p)
+			}
+		}()
+		h := r.Documents[rd.docId]
+		if h == nil {
+			err = fmt.Errorf("%w: document %s was removed", ErrReplication, rd.docId)
+			return
+		}
+		if !slices.Equal(rd.heads, h.LatestHashes()) {
+			if _, _, _, err = rd.session.Commit(0, 0, &org.ChunkChanges{}); err != nil {
+				return
+			}
+			rd.heads = slices.Clone(h.LatestHashes())
+		}
+		text = h.GetLatestDocument().String()
+	})
+	if err != nil {
+		return err
+	}
+	edit := replicaEdit{Replacements: textEdits(rd.base, text)}
+	var result *replicaEdit
+	if err := r.call(rd.client, http.MethodPost, server.SESSION_EDIT, edit, &result); err != nil {
+		return err
+	} else if len(edit.Replacements) > 0 {
+		r.logger.Debug("sent changes", "document", rd.docId)
+	}
+	rd.base = text
+	if result == nil || len(result.Replacements) == 0 {
+		return nil
+	}
+	// the remote's replacements are relative to the text it just received
+	if rd.base, err = applyEdits(text, result.Replacements); err != nil {
+		return err
+	}
+	r.logger.Debug("received changes", "document", rd.docId, "replacements", len(result.Replacements))
+	r.sync(func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%w: %v", ErrReplication, p)
+			}
+		}()
+		for _, repl := range result.Replacements {
+			rd.session.Replace(repl.Offset, repl.Length, repl.Text)
+		}
+		if _, _, _, err = rd.session.Commit(0, 0, &org.ChunkChanges{}); err == nil {
+			rd.heads = slices.Clone(r.Documents[rd.docId].LatestHashes())
+		}
+	})
+	return err
+}
+
+// call the remote peer, sending strings as text and other bodies as JSON
+func (r *replicator) call(client *http.Client, method, path string, body any, result any) error {
+	var reader io.Reader
+	contentType := "text/plain"
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		buf, err := json.Marshal(b)
+		if err != nil {
+			return fmt.Errorf("%w: could not encode request: %s", ErrReplication, err)
+		}
+		reader = bytes.NewReader(buf)
+		contentType = "application/json"
+	}
+	req, err := http.NewRequest(method, r.url.String()+path, reader)
+	if err != nil {
+		return fmt.Errorf("%w: bad request %s: %s", ErrReplication, path, err)
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: could not reach %s: %s", ErrReplication, r.url, err)
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%w: could not read response from %s: %s", ErrReplication, r.url, err)
+	} else if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("%w: %s refused: %s", ErrLinkRefused, r.url, buf)
+	} else if resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: %s %s returned %s: %s", ErrForbidden, method, path, resp.Status, buf)
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s %s returned %s: %s", ErrReplication, method, path, resp.Status, buf)
+	} else if result != nil && len(buf) > 0 {
+		if err := json.Unmarshal(buf, result); err != nil {
+			return fmt.Errorf("%w: bad response for %s: %s", ErrReplication, path, err)
+		}
+	}
+	return nil
+}
+
+// applyEdits applies replacements whose offsets are in the original text, in order.
+// The replacements come from the remote peer, so they must stay inside the text.
+func applyEdits(text string, repls []history.Replacement) (string, error) {
+	sb := &strings.Builder{}
+	pos := 0
+	for _, repl := range repls {
+		if repl.Length == -1 {
+			// a complete replacement
+			sb.Reset()
+			sb.WriteString(repl.Text)
+			pos = len(text)
+			continue
+		} else if repl.Offset < pos || repl.Length < 0 || repl.Offset > len(text) || repl.Length > len(text)-repl.Offset {
+			return "", fmt.Errorf("%w: replacement %d:%d is outside the text, expected offsets in order from %d to %d",
+				ErrReplication, repl.Offset, repl.Length, pos, len(text))
+		}
+		sb.WriteString(text[pos:repl.Offset])
+		sb.WriteString(repl.Text)
+		pos = repl.Offset + repl.Length
+	}
+	sb.WriteString(text[pos:])
+	return sb.String(), nil
+}
+
+// URL: GET /v1/peer/hello -- this peer's id, {"peer": ID}
+// URL: POST /v1/peer/hello -- body {"peer": ID}, accept a link from peer ID unless this peer links to it
+func (l *leisure) helloHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var hello struct {
+			Peer string `json:"peer"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&hello); err != nil || hello.Peer == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected {\"peer\": ID}", ErrReplication))))
+			return
+		}
+		var err error
+		l.sync(func() {
+			for _, rep := range l.replicators {
+				if rep.peer == hello.Peer {
+					err = fmt.Errorf("%w: this peer already replicates with peer %s at %s, which carries changes both ways", ErrLinkRefused, hello.Peer, rep.url)
+					return
+				}
+			}
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(server.ErrorJSON(err)))
+			return
+		}
+	}
+	writeJSON(w, map[string]string{"peer": l.peerId})
+}
+
+// URL: POST /v1/peer/replicate -- body {"url": URL, "token": TOKEN}, TLS trusts the peer's --replicate-ca-cert
+// URL: GET /v1/peer/replicate -- list the peers this one replicates with
+func (l *leisure) replicateHandler(w http.ResponseWriter, r *http.Request) {
+	var result any
+	if r.Method == http.MethodPost {
+		var link struct {
+			Url   string `json:"url"`
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected {\"url\": URL}", ErrReplication))))
+			return
+		} else if rep, err := l.replicate(link.Url, link.Token); err != nil {
+			if server.ErrorType(err) == ErrLinkRefused.Type {
+				w.WriteHeader(http.StatusConflict)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			w.Write([]byte(server.ErrorJSON(err)))
+			return
+		} else {
+			result = rep.getStatus()
+		}
+	} else {
+		var reps []*replicator
+		l.sync(func() {
+			for _, rep := range l.replicators {
+				reps = append(reps, rep)
+			}
+		})
+		statuses := make([]replicaStatus, 0, len(reps))
+		for _, rep := range reps {
+			statuses = append(statuses, rep.getStatus())
+		}
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].Url < statuses[j].Url })
+		result = statuses
+	}
+	buf, _ := json.Marshal(result)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+func (cmd *LinkCmd) Run(cli *CLI) error {
+	if cmd.Url == "" {
+		output(cli.get(REPLICATE))
+		return nil
+	}
+	link, _ := json.Marshal(map[string]string{
+		"url":   cmd.Url,
+		"token": cmd.RemoteToken,
+	})
+	output(cli.post(REPLICATE, bytes.NewReader(link)))
+	return nil
+}
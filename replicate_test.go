@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/org"
+	"github.com/leisure-tools/server"
+)
+
+// TEST_TOKEN is every test peer's token
+const TEST_TOKEN = "peer-token"
+
+// testPeer starts a peer with in-memory documents that serves the endpoints replication
+// uses behind its token and access checks, answering every request with an error while
+// down is set
+func testPeer(t *testing.T, name string) (l *leisure, srv *httptest.Server, down *atomic.Bool) {
+	mux := http.NewServeMux()
+	l = newLeisure(server.Initialize(name, mux, server.MemoryStorage), nil, server.MemoryStorage, peerIdFor(name))
+	mux.HandleFunc(REPLICATE, l.replicateHandler)
+	mux.HandleFunc(REPLICATE_HELLO, l.helloHandler)
+	mux.HandleFunc(DOC_TAGS, l.tagsHandler)
+	mux.HandleFunc(DOC_MEMBERS, l.membersHandler)
+	mux.HandleFunc(DOC_REGIONS, l.regionsHandler)
+	handler := authHandler(TEST_TOKEN, nil, l.accessGuard(mux))
+	down = &atomic.Bool{}
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		l.stopping.Store(true)
+		srv.Close()
+	})
+	return l, srv, down
+}
+
+// waitForText waits until a peer's copy of a document has the expected text
+func waitForText(t *testing.T, l *leisure, docId, expected string) {
+	t.Helper()
+	text := ""
+	for deadline := time.Now().Add(10 * REPLICATE_INTERVAL); time.Now().Before(deadline); time.Sleep(REPLICATE_INTERVAL / 10) {
+		if text = docText(l, docId); text == expected {
+			return
+		}
+	}
+	t.Fatalf("expected %q in %s, got %q", expected, docId, text)
+}
+
+// docText returns a peer's copy of a document
+func docText(l *leisure, docId string) (text string) {
+	l.sync(func() {
+		if h := l.Documents[docId]; h != nil {
+			text = h.GetLatestDocument().String()
+		}
+	})
+	return text
+}
+
+// editDoc commits a replacement from a session of the peer's own
+func editDoc(t *testing.T, l *leisure, docId, sessionId string, offset, length int, text string) {
+	t.Helper()
+	var err error
+	l.sync(func() {
+		s := l.Sessions[sessionId]
+		if s == nil {
+			if s, err = l.AddSession(sessionId, l.Documents[docId], false, true, false, 0); err != nil {
+				return
+			}
+		}
+		s.Replace(offset, length, text)
+		_, _, _, err = s.Commit(0, 0, &org.ChunkChanges{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicateTwoPeers(t *testing.T) {
+	a, srvA, _ := testPeer(t, "a")
+	b, srvB, _ := testPeer(t, "b")
+	a.sync(func() { a.addDocument("doc1", "notes", "one\n") })
+	if _, err := a.replicate(srvB.URL, TEST_TOKEN); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, "doc1", "one\n")
+	editDoc(t, a, "doc1", "edit-a", 4, 0, "two\n")
+	waitForText(t, b, "doc1", "one\ntwo\n")
+	editDoc(t, b, "doc1", "edit-b", 0, 0, "zero\n")
+	waitForText(t, a, "doc1", "zero\none\ntwo\n")
+	// the edits arrive once, however many passes go by
+	time.Sleep(3 * REPLICATE_INTERVAL)
+	waitForText(t, a, "doc1", "zero\none\ntwo\n")
+	waitForText(t, b, "doc1", "zero\none\ntwo\n")
+	if _, err := b.replicate(srvA.URL, TEST_TOKEN); server.ErrorType(err) != ErrLinkRefused.Type {
+		t.Errorf("expected the reverse link to be refused, got %v", err)
+	}
+	if _, err := a.replicate(srvA.URL, TEST_TOKEN); server.ErrorType(err) != ErrLinkRefused.Type {
+		t.Errorf("expected a link to itself to be refused, got %v", err)
+	}
+	b.sync(func() {
+		if len(b.replicators) != 0 {
+			t.Errorf("refused link is still listed: %v", b.replicators)
+		}
+	})
+}
+
+func TestReplicateLeavesOutMembersOnlyDocuments(t *testing.T) {
+	a, _, _ := testPeer(t, "a")
+	b, srvB, _ := testPeer(t, "b")
+	a.sync(func() {
+		a.addDocument("doc1", "notes", "one\n")
+		a.addDocument("doc2", "secrets", "two\n")
+		a.members["doc2"] = map[string]string{"alice": ROLE_OWNER}
+	})
+	if _, err := a.replicate(srvB.URL, TEST_TOKEN); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, "doc1", "one\n")
+	time.Sleep(2 * REPLICATE_INTERVAL)
+	if text := docText(b, "doc2"); text != "" {
+		t.Errorf("members-only document was copied without its members: %q", text)
+	}
+}
+
+func TestReplicateAfterLinkDown(t *testing.T) {
+	a, _, _ := testPeer(t, "a")
+	b, srvB, downB := testPeer(t, "b")
+	a.sync(func() { a.addDocument("doc1", "notes", "one\n") })
+	if _, err := a.replicate(srvB.URL, TEST_TOKEN); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, "doc1", "one\n")
+	downB.Store(true)
+	editDoc(t, a, "doc1", "edit-a", 4, 0, "two\n")
+	editDoc(t, b, "doc1", "edit-b", 0, 0, "zero\n")
+	time.Sleep(2 * REPLICATE_INTERVAL)
+	downB.Store(false)
+	// linking again merges both peers' edits instead of sending a's text over b's
+	waitForText(t, b, "doc1", "zero\none\ntwo\n")
+	waitForText(t, a, "doc1", "zero\none\ntwo\n")
+}
+
+func TestReplicateConflictingEdits(t *testing.T) {
+	a, _, _ := testPeer(t, "a")
+	b, srvB, _ := testPeer(t, "b")
+	a.sync(func() { a.addDocument("doc1", "notes", "one\ntwo\n") })
+	if _, err := a.replicate(srvB.URL, TEST_TOKEN); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, "doc1", "one\ntwo\n")
+	// both peers replace the same line before either hears of the other's edit
+	editDoc(t, a, "doc1", "edit-a", 0, 3, "uno")
+	editDoc(t, b, "doc1", "edit-b", 0, 3, "eins")
+	textA, textB := "", ""
+	for deadline := time.Now().Add(10 * REPLICATE_INTERVAL); time.Now().Before(deadline); time.Sleep(REPLICATE_INTERVAL / 10) {
+		if textA, textB = docText(a, "doc1"), docText(b, "doc1"); textA == textB && strings.Contains(textA, "uno") && strings.Contains(textA, "eins") {
+			break
+		}
+	}
+	if textA != textB {
+		t.Fatalf("peers did not converge: %q and %q", textA, textB)
+	}
+	// each edit arrives once, keeping both replacements and dropping the old line
+	for _, word := range []string{"uno", "eins"} {
+		if strings.Count(textA, word) != 1 {
+			t.Errorf("expected %s once in %q", word, textA)
+		}
+	}
+	if strings.Contains(textA, "one") || !strings.HasSuffix(textA, "\ntwo\n") {
+		t.Errorf("expected both replacements of the first line in %q", textA)
+	}
+}
+
+func TestApplyEditsOutsideText(t *testing.T) {
+	text := "one\ntwo\n"
+	if result, err := applyEdits(text, []history.Replacement{{Offset: 0, Length: 3, Text: "uno"}, {Offset: 4, Length: 3, Text: "dos"}}); err != nil {
+		t.Fatal(err)
+	} else if result != "uno\ndos\n" {
+		t.Errorf("expected edited text, got %q", result)
+	}
+	for _, repls := range [][]history.Replacement{
+		{{Offset: len(text) + 1, Length: 0, Text: "x"}},
+		{{Offset: 4, Length: len(text), Text: "x"}},
+		{{Offset: 4, Length: -2, Text: "x"}},
+		{{Offset: 4, Length: 3, Text: "dos"}, {Offset: 0, Length: 3, Text: "uno"}},
+	} {
+		if _, err := applyEdits(text, repls); err == nil {
+			t.Errorf("expected an error for %v", repls)
+		}
+	}
+}
+
+func TestReplicateLockedRegions(t *testing.T) {
+	a, _, _ := testPeer(t, "a")
+	b, srvB, _ := testPeer(t, "b")
+	lockId := regionId(REGION_HEADLINE, "locked")
+	a.sync(func() {
+		a.addDocument("doc1", "notes", "* locked\none\n* open\ntwo\n")
+		a.saveRegions("doc1", []*regionLock{{Id: lockId, Role: ROLE_OWNER, Changed: time.Now()}})
+	})
+	if _, err := a.replicate(srvB.URL, TEST_TOKEN); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, "doc1", "* locked\none\n* open\ntwo\n")
+	waitForRegions(t, b, "doc1", lockId)
+	// edits made inside the lock on either peer go through the link
+	editDoc(t, a, "doc1", "edit-a", len("* locked\n"), 0, "zero\n")
+	waitForText(t, b, "doc1", "* locked\nzero\none\n* open\ntwo\n")
+	editDoc(t, b, "doc1", "edit-b", len("* locked\nzero\n"), 0, "half\n")
+	waitForText(t, a, "doc1", "* locked\nzero\nhalf\none\n* open\ntwo\n")
+	// unlocking on the other peer goes back too
+	req, err := http.NewRequest(http.MethodDelete, srvB.URL+DOC_REGIONS+"doc1/"+url.PathEscape(lockId), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+TEST_TOKEN)
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("could not unlock %s: %s", lockId, resp.Status)
+	}
+	waitForRegions(t, a, "doc1")
+}
+
+// waitForRegions waits until a peer's document has exactly the expected locked regions
+func waitForRegions(t *testing.T, l *leisure, docId string, expected ...string) {
+	t.Helper()
+	var ids []string
+	for deadline := time.Now().Add(10 * REPLICATE_INTERVAL); time.Now().Before(deadline); time.Sleep(REPLICATE_INTERVAL / 10) {
+		ids = nil
+		l.sync(func() {
+			for _, lock := range liveRegions(l.regions[docId]) {
+				ids = append(ids, lock.Id)
+			}
+		})
+		if slices.Equal(ids, expected) {
+			return
+		}
+	}
+	t.Fatalf("expected locked regions %v in %s, got %v", expected, docId, ids)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/org"
+	"github.com/leisure-tools/server"
+)
+
+const (
+	SEARCH        = server.VERSION + "/search"
+	SEARCH_LIMIT  = 100
+	INDEX_SESSION = "INDEX-"
+)
+
+// searchIndex maps words, block names and linked attachments to the chunks that have them
+// in every document. Each document has an INDEX- session that follows its changes,
+// indexing again only the chunks they touched, so searches and attachment checks only
+// read the index. Tags are indexed for their attachments when they are added.
+type searchIndex struct {
+	docs     map[string]*searchDoc
+	words    map[string]map[searchKey]bool
+	names    map[string]map[searchKey]bool
+	files    map[string]map[searchKey]bool  // attachment hashes
+	tagFiles map[string]map[string][]string // document -> tag -> attachment hashes its text links to
+}
+
+type searchKey struct {
+	doc   string
+	chunk org.OrgId
+}
+
+type searchDoc struct {
+	session *server.LeisureSession // its chunks are the document's latest chunks
+	heads   []history.Sha
+	words   map[org.OrgId][]string // the words indexed for each chunk
+	names   map[org.OrgId]string
+	files   map[org.OrgId][]string // the attachments each chunk links to
+}
+
+type searchMatch struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+// searchResult is a chunk that has every word in the query
+type searchResult struct {
+	Document string        `json:"document"`
+	Alias    string        `json:"alias,omitempty"`
+	Path     []string      `json:"path"` // enclosing headlines, outermost first
+	Block    string        `json:"block,omitempty"`
+	Chunk    org.OrgId     `json:"chunk"`
+	Offset   int           `json:"offset"`
+	Matches  []searchMatch `json:"matches"` // document offsets of the query's words
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		docs:     map[string]*searchDoc{},
+		words:    map[string]map[searchKey]bool{},
+		names:    map[string]map[searchKey]bool{},
+		files:    map[string]map[searchKey]bool{},
+		tagFiles: map[string]map[string][]string{},
+	}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// words finds the lowercase words in text and their offsets
+func words(text string) ([]string, []searchMatch) {
+	var result []string
+	var matches []searchMatch
+	start := -1
+	for i, r := range text + " " {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			result = append(result, strings.ToLower(text[start:i]))
+			matches = append(matches, searchMatch{Offset: start, Length: i - start})
+			start = -1
+		}
+	}
+	return result, matches
+}
+
+func (idx *searchIndex) addChunk(docId string, sd *searchDoc, ch org.Chunk) {
+	basic := ch.AsOrgChunk()
+	found, _ := words(basic.Text)
+	slices.Sort(found)
+	found = slices.Compact(found)
+	key := searchKey{docId, basic.Id}
+	for _, word := range found {
+		if idx.words[word] == nil {
+			idx.words[word] = map[searchKey]bool{}
+		}
+		idx.words[word][key] = true
+	}
+	sd.words[basic.Id] = found
+	if name := org.Name(ch); name != "" {
+		if idx.names[name] == nil {
+			idx.names[name] = map[searchKey]bool{}
+		}
+		idx.names[name][key] = true
+		sd.names[basic.Id] = name
+	}
+	if hashes := linkedFiles(basic.Text); len(hashes) > 0 {
+		for _, hash := range hashes {
+			if idx.files[hash] == nil {
+				idx.files[hash] = map[searchKey]bool{}
+			}
+			idx.files[hash][key] = true
+		}
+		sd.files[basic.Id] = hashes
+	}
+}
+
+func (idx *searchIndex) removeChunk(docId string, sd *searchDoc, id org.OrgId) {
+	key := searchKey{docId, id}
+	for _, word := range sd.words[id] {
+		if delete(idx.words[word], key); len(idx.words[word]) == 0 {
+			delete(idx.words, word)
+		}
+	}
+	delete(sd.words, id)
+	if name, ok := sd.names[id]; ok {
+		if delete(idx.names[name], key); len(idx.names[name]) == 0 {
+			delete(idx.names, name)
+		}
+		delete(sd.names, id)
+	}
+	for _, hash := range sd.files[id] {
+		if delete(idx.files[hash], key); len(idx.files[hash]) == 0 {
+			delete(idx.files, hash)
+		}
+	}
+	delete(sd.files, id)
+}
+
+func (idx *searchIndex) removeDoc(docId string) {
+	if sd := idx.docs[docId]; sd != nil {
+		for id := range sd.words {
+			idx.removeChunk(docId, sd, id)
+		}
+		delete(idx.docs, docId)
+	}
+	delete(idx.tagFiles, docId)
+}
+
+// indexTag records the attachments a tag's text links to, replacing the tag's old entry
+func (idx *searchIndex) indexTag(docId string, tag *versionTag) {
+	if idx.tagFiles[docId] == nil {
+		idx.tagFiles[docId] = map[string][]string{}
+	}
+	idx.tagFiles[docId][tag.Name] = linkedFiles(tag.Text)
+}
+
+// indexDoc indexes every chunk of a document again
+func (idx *searchIndex) indexDoc(docId string, sd *searchDoc) {
+	for id := range sd.words {
+		idx.removeChunk(docId, sd, id)
+	}
+	for ch := range sd.session.Chunks.Seq() {
+		idx.addChunk(docId, sd, ch)
+	}
+}
+
+// indexDocument indexes a new document and follows its changes, called in the service goroutine
+func (l *leisure) indexDocument(docId string) {
+	h := l.Documents[docId]
+	s := l.Sessions[INDEX_SESSION+docId]
+	if s == nil {
+		var err error
+		if s, err = l.AddSession(INDEX_SESSION+docId, h, true, false, false, 0); err != nil {
+			panic(err)
+		}
+	}
+	if _, _, _, err := s.Commit(0, 0, &org.ChunkChanges{}); err != nil {
+		panic(err)
+	}
+	s.Chunks = org.Parse(s.LatestBlock().GetDocument(h).String())
+	s.Connect()
+	l.index.removeDoc(docId)
+	sd := &searchDoc{
+		session: s,
+		heads:   slices.Clone(h.LatestHashes()),
+		words:   map[org.OrgId][]string{},
+		names:   map[org.OrgId]string{},
+		files:   map[org.OrgId][]string{},
+	}
+	l.index.docs[docId] = sd
+	l.index.indexDoc(docId, sd)
+	for _, tag := range l.tags[docId] {
+		l.index.indexTag(docId, tag)
+	}
+	go l.followIndex(docId, sd)
+}
+
+// followIndex updates a document's entries whenever its index session hears of a change
+func (l *leisure) followIndex(docId string, sd *searchDoc) {
+	for range sd.session.Updates {
+		following := true
+		l.sync(func() { following = l.updateIndex(docId, sd) })
+		if !following {
+			return
+		}
+	}
+}
+
+// updateIndex indexes the chunks that changed since the index session last committed,
+// called in the service goroutine. It returns false once the document is gone.
+func (l *leisure) updateIndex(docId string, sd *searchDoc) bool {
+	idx := l.index
+	if idx.docs[docId] != sd {
+		return false
+	} else if l.Documents[docId] == nil || l.Sessions[INDEX_SESSION+docId] != sd.session {
+		idx.removeDoc(docId)
+		return false
+	}
+	h := sd.session.History
+	if slices.Equal(sd.heads, h.LatestHashes()) {
+		return true
+	}
+	changes := &org.ChunkChanges{}
+	if _, _, _, err := sd.session.Commit(0, 0, changes); err != nil {
+		logFor(LOG_PEER).Error("could not index document", "document", docId, "error", err)
+		return true
+	}
+	sd.heads = slices.Clone(h.LatestHashes())
+	if text := sd.session.LatestBlock().GetDocument(h).String(); sd.session.Chunks.Chunks.Measure().Width != len(text) {
+		// the session did not track chunks for these changes
+		sd.session.Chunks = org.Parse(text)
+		idx.indexDoc(docId, sd)
+		return true
+	}
+	for _, id := range changes.Removed {
+		idx.removeChunk(docId, sd, id)
+	}
+	for id := range changes.Added.Union(changes.Changed) {
+		idx.removeChunk(docId, sd, id)
+		if ch := sd.session.Chunks.ChunkIds[id]; ch != nil {
+			idx.addChunk(docId, sd, ch)
+		}
+	}
+	// blocks inherit options from their headlines
+	sd.session.Chunks.RelinkHierarchy(nil)
+	return true
+}
+
+// search finds the chunks with every word in the query, called in the service goroutine
+func (l *leisure) search(query, user string, limit int) []*searchResult {
+	idx := l.index
+	terms, _ := words(query)
+	if len(terms) == 0 {
+		return []*searchResult{}
+	}
+	var keys map[searchKey]bool
+	for _, term := range terms {
+		next := map[searchKey]bool{}
+		for key := range idx.words[term] {
+			if keys == nil || keys[key] {
+				next[key] = true
+			}
+		}
+		keys = next
+	}
+	found := map[string]map[org.OrgId]bool{}
+	for key := range keys {
+		if role := l.roleFor(key.doc, user); hasRole(role, ROLE_VIEWER) {
+			if found[key.doc] == nil {
+				found[key.doc] = map[org.OrgId]bool{}
+			}
+			found[key.doc][key.chunk] = true
+		}
+	}
+	docIds := make([]string, 0, len(found))
+	for docId := range found {
+		docIds = append(docIds, docId)
+	}
+	sort.Strings(docIds)
+	results := []*searchResult{}
+	for _, docId := range docIds {
+		alias := ""
+		if aliases := l.aliasesFor(docId); len(aliases) > 0 {
+			alias = aliases[0]
+		}
+		// walk the chunks for offsets and headline paths
+		var path []string
+		var levels []int
+		offset := 0
+		for ch := range idx.docs[docId].session.Chunks.Seq() {
+			basic := ch.AsOrgChunk()
+			if hl, ok := ch.(*org.Headline); ok {
+				for len(levels) > 0 && levels[len(levels)-1] >= hl.Level {
+					path, levels = path[:len(path)-1], levels[:len(levels)-1]
+				}
+				line, _, _ := strings.Cut(basic.Text, "\n")
+				path = append(path, strings.TrimSpace(strings.TrimLeft(line, "*")))
+				levels = append(levels, hl.Level)
+			}
+			if found[docId][basic.Id] {
+				result := &searchResult{
+					Document: docId,
+					Alias:    alias,
+					Path:     slices.Clone(path),
+					Block:    org.Name(ch),
+					Chunk:    basic.Id,
+					Offset:   offset,
+					Matches:  []searchMatch{},
+				}
+				chunkWords, matches := words(basic.Text)
+				for i, word := range chunkWords {
+					if slices.Contains(terms, word) {
+						matches[i].Offset += offset
+						result.Matches = append(result.Matches, matches[i])
+					}
+				}
+				if results = append(results, result); len(results) >= limit {
+					return results
+				}
+			}
+			offset += len(basic.Text)
+		}
+	}
+	return results
+}
+
+// URL: GET /v1/search?q=QUERY -- chunks with every word in QUERY in the documents the identity can view
+// URL: GET /v1/search?q=QUERY&limit=N -- at most N chunks, 100 by default
+func (l *leisure) searchHandler(w http.ResponseWriter, r *http.Request) {
+	user := identity(r)
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 {
+		limit = SEARCH_LIMIT
+	}
+	if query.Get("q") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected %s?q=QUERY", ErrBadCommand, SEARCH))))
+		return
+	}
+	var results []*searchResult
+	var err error
+	l.sync(func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%w: %v", server.ErrInternalError, p)
+			}
+		}()
+		results = l.search(query.Get("q"), user, limit)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+		return
+	}
+	writeJSON(w, results)
+}
+
+func (cmd *SearchCmd) Run(cli *CLI) error {
+	query := url.Values{}
+	query.Set("q", strings.Join(cmd.Query, " "))
+	if cmd.Limit > 0 {
+		query.Set("limit", strconv.Itoa(cmd.Limit))
+	}
+	output(cli.get(SEARCH + "?" + query.Encode()))
+	return nil
+}
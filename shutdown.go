@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/leisure-tools/server"
+)
+
+const (
+	SHUTDOWN         = server.VERSION + "/shutdown"
+	SHUTDOWN_TIMEOUT = 10 * time.Second
+	STOP_POLL        = 100 * time.Millisecond
+)
+
+var ErrStopping = server.NewLeisureError("peerStopping")
+
+// addServer registers an HTTP server so shutdown can drain it
+func (l *leisure) addServer(srv *http.Server) *http.Server {
+	l.serverLock.Lock()
+	defer l.serverLock.Unlock()
+	l.servers = append(l.servers, srv)
+	return srv
+}
+
+// stopGuard refuses new requests once the peer is stopping
+func (l *leisure) stopGuard(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.stopping.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: the peer is shutting down", ErrStopping))))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// stop gracefully on the first SIGINT or SIGTERM, immediately on the second
+func (l *leisure) handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		go func() {
+			second := <-signals
+			logFor(LOG_PEER).Warn("stopping immediately", "signal", second.String())
+			os.Exit(1)
+		}()
+		l.shutdown(sig.String())
+		os.Exit(exitCode)
+	}()
+}
+
+// URL: GET or POST /shutdown
+// respond with the peer's counts, then stop gracefully
+func (l *leisure) shutdownHandler(w http.ResponseWriter, r *http.Request) {
+	var result map[string]any
+	l.sync(func() {
+		result = map[string]any{
+			"stopping":  true,
+			"pid":       os.Getpid(),
+			"documents": len(l.Documents),
+			"sessions":  len(l.Sessions),
+		}
+	})
+	buf, _ := json.Marshal(result)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+	go l.shutdown("stop command")
+}
+
+// shutdown wakes long polls, sends pending monitor changes, drains the servers, and
+// flushes the store with current markers. Only the first call does anything, later calls wait for it.
+func (l *leisure) shutdown(reason string) {
+	l.stopOnce.Do(func() {
+		logFor(LOG_PEER).Info("stopping peer", "reason", reason)
+		l.stopping.Store(true)
+		l.sync(func() {
+			// wake sessions in long polls; their next request reports that the peer is stopping
+			for _, s := range l.Sessions {
+				s.HasUpdate = true
+				if s.Updates != nil {
+					updates := s.Updates
+					go func() { updates <- true }()
+				}
+			}
+			for id, dm := range l.Monitors {
+				l.flushMonitor(id, dm)
+			}
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		l.serverLock.Lock()
+		servers := append([]*http.Server{}, l.servers...)
+		l.serverLock.Unlock()
+		for _, srv := range servers {
+			if err := srv.Shutdown(ctx); err != nil {
+				logFor(LOG_PEER).Error("could not stop server", "addr", srv.Addr, "error", err)
+				srv.Close()
+			}
+		}
+		if l.store != nil {
+			// markers are saved where they are in the latest documents
+			l.sync(l.followAllMarkers)
+			l.sync(l.store.close)
+		}
+		if l.pidFile != "" {
+			os.Remove(l.pidFile)
+		}
+		close(l.stopped)
+	})
+	<-l.stopped
+}
+
+// send a monitored document's unsent changes to REDIS
+func (l *leisure) flushMonitor(id string, dm *docMonitor) {
+	defer func() {
+		if err := recover(); err != nil {
+			dm.stats.errors.Add(1)
+			dm.logger.Error("could not flush monitor", "error", err)
+		}
+	}()
+	dm.updateSession()
+}
+
+func (cmd *StopCmd) Run(cli *CLI) error {
+	cli.globals.UnixSocket = cmd.UnixSocket
+	cli.globals.Port = cmd.Port
+	cli.globals.Host = cmd.Host
+	cli.globals.Verbose = cmd.Verbose
+	if err := configureLogging(cmd.Verbose, nil, "", ""); err != nil {
+		panicWith("%w", err)
+	}
+	cli.globals.Token = cmd.Token
+	cli.globals.Tls = cmd.Tls
+	cli.globals.CaCert = cmd.CaCert
+	resp := cli.get(SHUTDOWN)
+	if !cmd.Wait || resp.StatusCode != http.StatusOK {
+		output(resp)
+		return nil
+	}
+	var stopping struct{ Pid int }
+	err := json.NewDecoder(resp.Body).Decode(&stopping)
+	resp.Body.Close()
+	if err != nil {
+		panic(err)
+	}
+	start := time.Now()
+	for time.Since(start) < time.Duration(cmd.Timeout)*time.Millisecond {
+		if !cli.peerRunning(stopping.Pid) {
+			fmt.Printf(`{"stopped":true,"seconds":%.3f}`, time.Since(start).Seconds())
+			return nil
+		}
+		time.Sleep(STOP_POLL)
+	}
+	exitCode = 1
+	fmt.Printf(`{"stopped":false,"error":"timeout","seconds":%.3f}`, time.Since(start).Seconds())
+	return nil
+}
+
+// peerRunning checks the process for a local peer, otherwise whether its port accepts connections
+func (cli *CLI) peerRunning(pid int) bool {
+	if cli.globals.Host == "" && pid > 0 {
+		return syscall.Kill(pid, 0) == nil
+	}
+	var conn net.Conn
+	var err error
+	if cli.globals.Host != "" {
+		conn, err = net.DialTimeout("tcp", fmt.Sprint(cli.globals.Host, ":", cli.globals.Port), time.Second)
+	} else {
+		conn, err = net.DialTimeout("unix", cli.globals.UnixSocket, time.Second)
+	}
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
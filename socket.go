@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/leisure-tools/server"
+)
+
+var ErrPeerRunning = server.NewLeisureError("peerRunning")
+
+// listenUnix listens on the peer's socket, removing a socket left by a peer that
+// is no longer running and applying --socket-mode and --socket-group
+func (cmd *PeerCmd) listenUnix() (*net.UnixListener, error) {
+	if err := reclaimSocket(cmd.UnixSocket); err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUnixAddr("unix", cmd.UnixSocket)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not resolve unix socket %s", ErrSocketFailure, cmd.UnixSocket)
+	}
+	listener, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not listen on unix socket %s: %s", ErrSocketFailure, cmd.UnixSocket, err)
+	}
+	listener.SetUnlinkOnClose(true)
+	if err := cmd.setSocketAccess(); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// reclaimSocket removes a stale socket file and refuses if a peer answers on it
+func reclaimSocket(name string) error {
+	info, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%w: could not check unix socket %s: %s", ErrSocketFailure, name, err)
+	} else if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%w: %s exists and is not a socket", ErrSocketFailure, name)
+	} else if conn, err := net.DialTimeout("unix", name, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: a peer is already running on %s", server.NewLeisureError(ErrPeerRunning.Type, "socket", name), name)
+	} else if err := os.Remove(name); err != nil {
+		return fmt.Errorf("%w: could not remove stale unix socket %s: %s", ErrSocketFailure, name, err)
+	}
+	logFor(LOG_PEER).Info("removed stale unix socket", "socket", name)
+	return nil
+}
+
+func (cmd *PeerCmd) setSocketAccess() error {
+	if cmd.SocketMode != "" {
+		if mode, err := strconv.ParseUint(cmd.SocketMode, 8, 32); err != nil || mode > 0777 {
+			return fmt.Errorf("%w: bad socket mode %s, expected octal permissions like 0660", ErrSocketFailure, cmd.SocketMode)
+		} else if err := os.Chmod(cmd.UnixSocket, fs.FileMode(mode)); err != nil {
+			return fmt.Errorf("%w: could not set mode of %s: %s", ErrSocketFailure, cmd.UnixSocket, err)
+		}
+	}
+	if cmd.SocketGroup != "" {
+		gid, err := strconv.Atoi(cmd.SocketGroup)
+		if err != nil {
+			if group, err := user.LookupGroup(cmd.SocketGroup); err != nil {
+				return fmt.Errorf("%w: unknown group %s", ErrSocketFailure, cmd.SocketGroup)
+			} else if gid, err = strconv.Atoi(group.Gid); err != nil {
+				return fmt.Errorf("%w: bad id for group %s: %s", ErrSocketFailure, cmd.SocketGroup, group.Gid)
+			}
+		}
+		if err := os.Chown(cmd.UnixSocket, -1, gid); err != nil {
+			return fmt.Errorf("%w: could not set group of %s: %s", ErrSocketFailure, cmd.UnixSocket, err)
+		}
+	}
+	return nil
+}
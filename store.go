@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/server"
+)
+
+const (
+	STORE_DOCS    = "docs"
+	STORE_META    = "meta.json"
+	STORE_SOURCE  = "source.org"
+	STORE_JOURNAL = "blocks.jsonl"
+	STORE_TAGS    = "tags.json"
+	STORE_COMPACT = "compacting"
+	STORE_OLD     = "replaced"
+)
+
+var ErrStorage = server.NewLeisureError("storageFailure")
+
+// docStore persists documents in a directory
+//
+//	DIR/meta.json                  -- aliases, sessions, members, locked regions, comments, markers, and forks
+//	DIR/docs/ID/source.org         -- initial document text
+//	DIR/docs/ID/blocks.jsonl       -- journal of history blocks, in commit order
+//	DIR/docs/ID/tags.json          -- named versions and their text
+//	DIR/compacting/ID              -- a compacted document, until it replaces DIR/docs/ID
+//	DIR/replaced/ID                -- a document compacting replaced, until it is removed
+//
+// Blocks are replayed through History.Commit on startup, which reproduces the
+// original hashes because commits on a peer are serialized.
+type docStore struct {
+	dir      string
+	logger   *slog.Logger
+	sv       *server.LeisureService
+	storages map[string]*fileStorage
+	meta     storeMeta
+	tags     documentTags
+}
+
+type storeMeta struct {
+	Aliases  map[string]string `json:"aliases"`
+	Sessions map[string]string `json:"sessions"` // session -> document
+	Members  documentMembers   `json:"members,omitempty"`
+	Regions  documentRegions   `json:"regions,omitempty"`
+	Comments documentComments  `json:"comments,omitempty"`
+	Markers  documentMarkers   `json:"markers,omitempty"`
+	Forks    documentForks     `json:"forks,omitempty"`
+	Deleted  deletedDocuments  `json:"deleted,omitempty"`
+}
+
+// timedStorage is a MemoryStorage that remembers when each block was committed
+type timedStorage struct {
+	*history.MemoryStorage
+	times map[history.Sha]time.Time
+}
+
+// fileStorage is a timedStorage that journals each new block to disk
+type fileStorage struct {
+	*timedStorage
+	store     *docStore
+	id        string
+	journal   *os.File
+	replaying bool
+}
+
+// the journal's representation of a history.OpBlock
+type blockRecord struct {
+	Hash            string                `json:"hash"`
+	Peer            string                `json:"peer"`
+	SessionId       string                `json:"sessionId"`
+	Nonce           int                   `json:"nonce"`
+	Parents         []string              `json:"parents"`
+	Replacements    []history.Replacement `json:"replacements"`
+	SelectionOffset int                   `json:"selectionOffset"`
+	SelectionLength int                   `json:"selectionLength"`
+	Time            time.Time             `json:"time,omitempty"`
+}
+
+func openStore(dir string) (*docStore, error) {
+	st := &docStore{
+		dir:      dir,
+		logger:   logFor(LOG_PEER).With("store", dir),
+		storages: map[string]*fileStorage{},
+		tags:     documentTags{},
+		meta: storeMeta{
+			Aliases:  map[string]string{},
+			Sessions: map[string]string{},
+		},
+	}
+	if err := os.MkdirAll(filepath.Join(dir, STORE_DOCS), 0700); err != nil {
+		return nil, fmt.Errorf("%w: could not create store directory %s: %s", ErrStorage, dir, err)
+	} else if buf, err := os.ReadFile(filepath.Join(dir, STORE_META)); err == nil {
+		if err := json.Unmarshal(buf, &st.meta); err != nil {
+			return nil, fmt.Errorf("%w: bad metadata in %s: %s", ErrStorage, dir, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: could not read metadata in %s: %s", ErrStorage, dir, err)
+	}
+	if st.meta.Aliases == nil {
+		st.meta.Aliases = map[string]string{}
+	}
+	if st.meta.Sessions == nil {
+		st.meta.Sessions = map[string]string{}
+	}
+	if st.meta.Members == nil {
+		st.meta.Members = documentMembers{}
+	}
+	if st.meta.Regions == nil {
+		st.meta.Regions = documentRegions{}
+	}
+	if st.meta.Comments == nil {
+		st.meta.Comments = documentComments{}
+	}
+	if st.meta.Markers == nil {
+		st.meta.Markers = documentMarkers{}
+	}
+	if st.meta.Forks == nil {
+		st.meta.Forks = documentForks{}
+	}
+	if st.meta.Deleted == nil {
+		st.meta.Deleted = deletedDocuments{}
+	}
+	return st, nil
+}
+
+func (st *docStore) docDir(id string) string {
+	return filepath.Join(st.dir, STORE_DOCS, url.PathEscape(id))
+}
+
+func (st *docStore) fail(format string, args ...any) {
+	st.logger.Error("store error", "error", fmt.Sprintf(format, args...))
+}
+
+// storage is the storage factory for server.Initialize, called for new documents
+func (st *docStore) storage(id, content string) history.DocStorage {
+	fst := &fileStorage{
+		timedStorage: newTimedStorage(content),
+		store:        st,
+		id:           id,
+	}
+	dir := st.docDir(id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		st.fail("could not create document directory %s: %s", dir, err)
+	} else if err := os.WriteFile(filepath.Join(dir, STORE_SOURCE), []byte(content), 0600); err != nil {
+		st.fail("could not write document source for %s: %s", id, err)
+	} else if fst.journal, err = os.Create(filepath.Join(dir, STORE_JOURNAL)); err != nil {
+		st.fail("could not create journal for %s: %s", id, err)
+	}
+	st.storages[id] = fst
+	return fst
+}
+
+func newTimedStorage(content string) *timedStorage {
+	return &timedStorage{
+		MemoryStorage: history.NewMemoryStorage(content),
+		times:         map[history.Sha]time.Time{},
+	}
+}
+
+// timedMemoryStorage is the storage factory for server.Initialize without a store
+func timedMemoryStorage(id, content string) history.DocStorage {
+	return newTimedStorage(content)
+}
+
+func (ts *timedStorage) StoreBlock(blk *history.OpBlock) {
+	ts.MemoryStorage.StoreBlock(blk)
+	// imported and compacted blocks arrive with their times
+	if _, ok := ts.times[blk.Hash]; !ok && len(blk.Parents) > 0 {
+		ts.times[blk.Hash] = time.Now().UTC()
+	}
+}
+
+// storageTimes returns the commit times a document's storage keeps, or nil
+func storageTimes(storage history.DocStorage) map[history.Sha]time.Time {
+	switch s := storage.(type) {
+	case *timedStorage:
+		return s.times
+	case *fileStorage:
+		return s.times
+	}
+	return nil
+}
+
+// blockTime returns when a block was committed, if its document's storage knows
+func blockTime(h *history.History, hash history.Sha) time.Time {
+	return storageTimes(h.Storage)[hash]
+}
+
+func (fst *fileStorage) StoreBlock(blk *history.OpBlock) {
+	fst.timedStorage.StoreBlock(blk)
+	if fst.replaying || len(blk.Parents) == 0 || fst.journal == nil {
+		return
+	}
+	rec := recordFor(blk)
+	rec.Time = fst.times[blk.Hash]
+	if buf, err := json.Marshal(rec); err != nil {
+		fst.store.fail("could not encode block for %s: %s", fst.id, err)
+	} else if _, err := fst.journal.Write(append(buf, '\n')); err != nil {
+		fst.store.fail("could not journal block for %s: %s", fst.id, err)
+	}
+	if fst.store.meta.Sessions[blk.SessionId] != fst.id {
+		fst.store.meta.Sessions[blk.SessionId] = fst.id
+		fst.store.saveMeta()
+	}
+}
+
+func recordFor(blk *history.OpBlock) *blockRecord {
+	parents := make([]string, 0, len(blk.Parents))
+	for _, p := range blk.Parents {
+		parents = append(parents, hex.EncodeToString(p[:]))
+	}
+	return &blockRecord{
+		Hash:            hex.EncodeToString(blk.Hash[:]),
+		Peer:            blk.Peer,
+		SessionId:       blk.SessionId,
+		Nonce:           blk.Nonce,
+		Parents:         parents,
+		Replacements:    blk.Replacements,
+		SelectionOffset: blk.SelectionOffset,
+		SelectionLength: blk.SelectionLength,
+	}
+}
+
+// load restores every stored document, alias, and session into the service
+// this must run before the peer starts serving requests
+func (st *docStore) load(sv *server.LeisureService) error {
+	st.sv = sv
+	if err := st.finishCompactions(); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Join(st.dir, STORE_DOCS))
+	if err != nil {
+		return fmt.Errorf("%w: could not read documents in %s: %s", ErrStorage, st.dir, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if id, err := url.PathUnescape(entry.Name()); err != nil {
+			return fmt.Errorf("%w: bad document directory %s", ErrStorage, entry.Name())
+		} else if h, err := st.loadDoc(id); err != nil {
+			return err
+		} else {
+			st.logger.Debug("restored document", "document", id, "blocks", len(h.Blocks))
+			sv.Documents[id] = h
+		}
+	}
+	for alias, id := range st.meta.Aliases {
+		if sv.Documents[id] != nil {
+			sv.DocumentAliases[alias] = id
+		}
+	}
+	for sessionId, id := range st.meta.Sessions {
+		if h := sv.Documents[id]; h != nil && !strings.HasPrefix(sessionId, "MONITOR-") {
+			if _, err := sv.AddSession(sessionId, h, false, true, false, 0); err != nil {
+				return fmt.Errorf("%w: could not restore session %s: %s", ErrStorage, sessionId, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (st *docStore) loadDoc(id string) (*history.History, error) {
+	dir := st.docDir(id)
+	source, err := os.ReadFile(filepath.Join(dir, STORE_SOURCE))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read source for %s: %s", ErrStorage, id, err)
+	}
+	fst := &fileStorage{
+		timedStorage: newTimedStorage(string(source)),
+		store:        st,
+		id:           id,
+		replaying:    true,
+	}
+	h := history.NewHistory(fst, string(source))
+	journalName := filepath.Join(dir, STORE_JOURNAL)
+	if file, err := os.Open(journalName); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			var rec blockRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%w: bad block in %s, line %d: %s", ErrStorage, journalName, line, err)
+			}
+			h.Commit(rec.Peer, rec.SessionId, rec.Replacements, rec.SelectionOffset, rec.SelectionLength)
+			if blk := h.Latest[rec.SessionId]; blk == nil || hex.EncodeToString(blk.Hash[:]) != rec.Hash {
+				file.Close()
+				return nil, fmt.Errorf("%w: block %s in %s, line %d, did not replay", ErrStorage, rec.Hash, journalName, line)
+			}
+			fst.times[h.Latest[rec.SessionId].Hash] = rec.Time
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%w: could not read %s: %s", ErrStorage, journalName, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: could not open %s: %s", ErrStorage, journalName, err)
+	}
+	fst.replaying = false
+	if buf, err := os.ReadFile(filepath.Join(dir, STORE_TAGS)); err == nil {
+		tags := map[string]*versionTag{}
+		if err := json.Unmarshal(buf, &tags); err != nil {
+			return nil, fmt.Errorf("%w: bad tags for %s: %s", ErrStorage, id, err)
+		}
+		for _, tag := range tags {
+			fst.StoreDocument(tag.Text)
+		}
+		st.tags[id] = tags
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: could not read tags for %s: %s", ErrStorage, id, err)
+	}
+	if fst.journal, err = os.OpenFile(journalName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return nil, fmt.Errorf("%w: could not open %s: %s", ErrStorage, journalName, err)
+	}
+	st.storages[id] = fst
+	return h, nil
+}
+
+// saveMeta writes the service's aliases and the sessions, replacing the old file atomically
+func (st *docStore) saveMeta() {
+	if st.sv != nil {
+		st.meta.Aliases = make(map[string]string, len(st.sv.DocumentAliases))
+		for alias, id := range st.sv.DocumentAliases {
+			st.meta.Aliases[alias] = id
+		}
+	}
+	name := filepath.Join(st.dir, STORE_META)
+	tmp := name + ".tmp"
+	if buf, err := json.MarshalIndent(&st.meta, "", "  "); err != nil {
+		st.fail("could not encode metadata: %s", err)
+	} else if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		st.fail("could not write metadata: %s", err)
+	} else if err := os.Rename(tmp, name); err != nil {
+		st.fail("could not replace metadata: %s", err)
+	}
+}
+
+// compactStorage is storage for a compacted document, it journals nothing until finishCompact
+func (st *docStore) compactStorage(id, snapshot string) *fileStorage {
+	return &fileStorage{
+		timedStorage: newTimedStorage(snapshot),
+		store:        st,
+		id:           id,
+		replaying:    true,
+	}
+}
+
+// finishCompact replaces a document's directory with one holding its compacted history.
+// The new directory is written aside, then moving the old one out of the way commits the
+// compaction: load finishes a compaction that got that far and discards one that did not.
+// The old journal stays open until the compaction commits.
+func (st *docStore) finishCompact(id string, fst *fileStorage, h *history.History) error {
+	blocks := make([]*history.OpBlock, 0, len(h.GetBlockOrder()))
+	for _, hash := range h.GetBlockOrder() {
+		if blk := h.GetBlock(hash); blk != nil && len(blk.Parents) > 0 {
+			blocks = append(blocks, blk)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Nonce < blocks[j].Nonce })
+	journal := &bytes.Buffer{}
+	for _, blk := range blocks {
+		rec := recordFor(blk)
+		rec.Time = fst.times[blk.Hash]
+		buf, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("%w: could not encode block for %s: %s", ErrStorage, id, err)
+		}
+		journal.Write(append(buf, '\n'))
+	}
+	dir := st.docDir(id)
+	newDir := filepath.Join(st.dir, STORE_COMPACT, url.PathEscape(id))
+	oldDir := filepath.Join(st.dir, STORE_OLD, url.PathEscape(id))
+	newJournal, err := st.writeCompacted(id, dir, newDir, h.Source.GetDocument(h).String(), journal.Bytes())
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(oldDir), 0700); err == nil {
+			os.RemoveAll(oldDir)
+			err = os.Rename(dir, oldDir)
+		}
+		if err != nil {
+			newJournal.Close()
+			err = fmt.Errorf("%w: could not move %s aside: %s", ErrStorage, dir, err)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(newDir)
+		return err
+	}
+	// committed, load finishes moving the new directory into place if this fails
+	if err := os.Rename(newDir, dir); err != nil {
+		st.fail("could not move compacted %s into place, it will move on restart: %s", id, err)
+	} else if err := os.RemoveAll(oldDir); err != nil {
+		st.fail("could not remove %s: %s", oldDir, err)
+	}
+	if old := st.storages[id]; old != nil && old.journal != nil {
+		old.journal.Close()
+		old.journal = nil
+	}
+	fst.journal = newJournal
+	fst.replaying = false
+	st.storages[id] = fst
+	return nil
+}
+
+// writeCompacted writes a compacted document's directory with the old one's tags,
+// returning its open journal
+func (st *docStore) writeCompacted(id, dir, newDir, source string, journal []byte) (*os.File, error) {
+	journalName := filepath.Join(newDir, STORE_JOURNAL)
+	if err := os.RemoveAll(newDir); err != nil {
+		return nil, fmt.Errorf("%w: could not remove %s: %s", ErrStorage, newDir, err)
+	} else if err := os.MkdirAll(newDir, 0700); err != nil {
+		return nil, fmt.Errorf("%w: could not create %s: %s", ErrStorage, newDir, err)
+	} else if err := os.WriteFile(filepath.Join(newDir, STORE_SOURCE), []byte(source), 0600); err != nil {
+		return nil, fmt.Errorf("%w: could not write source for %s: %s", ErrStorage, id, err)
+	} else if err := os.WriteFile(journalName, journal, 0600); err != nil {
+		return nil, fmt.Errorf("%w: could not write journal for %s: %s", ErrStorage, id, err)
+	} else if tags, err := os.ReadFile(filepath.Join(dir, STORE_TAGS)); err == nil {
+		if err := os.WriteFile(filepath.Join(newDir, STORE_TAGS), tags, 0600); err != nil {
+			return nil, fmt.Errorf("%w: could not write tags for %s: %s", ErrStorage, id, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: could not read tags for %s: %s", ErrStorage, id, err)
+	}
+	file, err := os.OpenFile(journalName, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not open %s: %s", ErrStorage, journalName, err)
+	}
+	return file, nil
+}
+
+// finishCompactions moves compacted documents into place when their old directories
+// were moved aside and discards the rest, as the store loads
+func (st *docStore) finishCompactions() error {
+	compacting := filepath.Join(st.dir, STORE_COMPACT)
+	entries, err := os.ReadDir(compacting)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%w: could not read %s: %s", ErrStorage, compacting, err)
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(st.dir, STORE_DOCS, entry.Name())
+		newDir := filepath.Join(compacting, entry.Name())
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if err := os.Rename(newDir, dir); err != nil {
+				return fmt.Errorf("%w: could not finish compacting %s: %s", ErrStorage, entry.Name(), err)
+			}
+			st.logger.Info("finished compacting document", "document", entry.Name())
+		} else if err := os.RemoveAll(newDir); err != nil {
+			return fmt.Errorf("%w: could not remove %s: %s", ErrStorage, newDir, err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(st.dir, STORE_OLD)); err != nil {
+		return fmt.Errorf("%w: could not remove replaced documents: %s", ErrStorage, err)
+	}
+	return nil
+}
+
+// saveTags writes a document's tags, replacing the old file atomically
+func (st *docStore) saveTags(id string) {
+	name := filepath.Join(st.docDir(id), STORE_TAGS)
+	tmp := name + ".tmp"
+	if buf, err := json.MarshalIndent(st.tags[id], "", "  "); err != nil {
+		st.fail("could not encode tags for %s: %s", id, err)
+	} else if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		st.fail("could not write tags for %s: %s", id, err)
+	} else if err := os.Rename(tmp, name); err != nil {
+		st.fail("could not replace tags for %s: %s", id, err)
+	}
+}
+
+// removeDocument deletes a document's directory and the metadata that refers to it
+func (st *docStore) removeDocument(id string) {
+	if fst := st.storages[id]; fst != nil && fst.journal != nil {
+		fst.journal.Close()
+		fst.journal = nil
+	}
+	delete(st.storages, id)
+	delete(st.tags, id)
+	for sessionId, docId := range st.meta.Sessions {
+		if docId == id {
+			delete(st.meta.Sessions, sessionId)
+		}
+	}
+	if err := os.RemoveAll(st.docDir(id)); err != nil {
+		st.fail("could not delete document directory for %s: %s", id, err)
+	}
+	st.saveMeta()
+}
+
+// NewDocument records the new document's alias
+func (st *docStore) NewDocument(sv *server.LeisureService, id string) {
+	st.sv = sv
+	st.saveMeta()
+}
+
+// close flushes the journals and metadata
+func (st *docStore) close() {
+	st.saveMeta()
+	for _, fst := range st.storages {
+		if fst.journal != nil {
+			fst.journal.Sync()
+			fst.journal.Close()
+			fst.journal = nil
+		}
+	}
+}
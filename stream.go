@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/leisure-tools/server"
+)
+
+const SESSION_STREAM = server.VERSION + "/session/stream"
+
+// stream event types
+const (
+	STREAM_UPDATE   = "update"
+	STREAM_FAILURE  = "failure"
+	STREAM_STOPPING = "stopping"
+)
+
+// bufferedResponse collects the response of a request made to the service's own handlers
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(buf []byte) (int, error) {
+	return b.body.Write(buf)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+// call one of the service's handlers with the cookies from r
+func internalRequest(mux http.Handler, r *http.Request, method, path string, body []byte) *bufferedResponse {
+	req, err := http.NewRequestWithContext(r.Context(), method, path, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Cookie", r.Header.Get("Cookie"))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	mux.ServeHTTP(resp, req)
+	return resp
+}
+
+func writeEvent(w io.Writer, event string, data []byte) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(string(bytes.TrimSpace(data)), "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// URL: GET /v1/session/stream -- Server-Sent Events for the session in the cookie
+// URL: GET /v1/session/stream?selectionOffset=N&selectionLength=N -- with the client's selection
+// URL: GET /v1/session/stream?notify=true -- only announce updates
+//
+// Each update event carries what a null SESSION_EDIT returns: replacements and the
+// transformed selection, org chunk changes, or data changes. Streaming commits the session
+// like a null edit, so clients apply each update before sending edits. Clients that keep
+// unsent edits use notify mode and send them with SESSION_EDIT when an update arrives.
+// The stream waits on SESSION_UPDATE, so a session should have only one stream or long poll.
+func (l *leisure) streamHandler(mux http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: streaming is not supported on this connection", ErrBadCommand))))
+			return
+		}
+		query := r.URL.Query()
+		notify := query.Get("notify") == "true"
+		var selection struct {
+			SelectionOffset int `json:"selectionOffset"`
+			SelectionLength int `json:"selectionLength"`
+		}
+		selection.SelectionOffset, _ = strconv.Atoi(query.Get("selectionOffset"))
+		selection.SelectionLength, _ = strconv.Atoi(query.Get("selectionLength"))
+		nullEdit := func() *bufferedResponse {
+			buf, _ := json.Marshal(map[string]any{
+				"selectionOffset": selection.SelectionOffset,
+				"selectionLength": selection.SelectionLength,
+				"replacements":    []any{},
+			})
+			resp := internalRequest(mux, r, http.MethodPost, server.SESSION_EDIT, buf)
+			if resp.status == http.StatusOK {
+				json.Unmarshal(resp.body.Bytes(), &selection)
+			}
+			return resp
+		}
+		// check the session and send changes it has not seen yet
+		var first *bufferedResponse
+		if notify {
+			first = internalRequest(mux, r, http.MethodGet, server.SESSION_DOCUMENT, nil)
+		} else {
+			first = nullEdit()
+		}
+		if first.status != http.StatusOK {
+			w.WriteHeader(first.status)
+			w.Write(first.body.Bytes())
+			return
+		}
+		for _, cookie := range first.header.Values("Set-Cookie") {
+			w.Header().Add("Set-Cookie", cookie)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if !notify {
+			writeEvent(w, STREAM_UPDATE, first.body.Bytes())
+		}
+		flusher.Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			default:
+			}
+			if l.stopping.Load() {
+				writeEvent(w, STREAM_STOPPING, []byte("true"))
+				flusher.Flush()
+				return
+			}
+			update := internalRequest(mux, r, http.MethodGet, server.SESSION_UPDATE, nil)
+			if update.status != http.StatusOK {
+				writeEvent(w, STREAM_FAILURE, update.body.Bytes())
+				flusher.Flush()
+				return
+			} else if strings.TrimSpace(update.body.String()) != "true" {
+				// keep proxies from closing an idle stream
+				fmt.Fprint(w, ": idle\n\n")
+			} else if notify {
+				writeEvent(w, STREAM_UPDATE, []byte("true"))
+			} else if edit := nullEdit(); edit.status != http.StatusOK {
+				writeEvent(w, STREAM_FAILURE, edit.body.Bytes())
+				flusher.Flush()
+				return
+			} else {
+				writeEvent(w, STREAM_UPDATE, edit.body.Bytes())
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// print each update's data on its own line
+func (cmd *SessionStreamCmd) Run(cli *CLI) error {
+	query := []string{}
+	if cmd.Notify {
+		query = append(query, "notify=true")
+	}
+	if cmd.SelectionOffset != 0 || cmd.SelectionLength != 0 {
+		query = append(query, fmt.Sprint("selectionOffset=", cmd.SelectionOffset), fmt.Sprint("selectionLength=", cmd.SelectionLength))
+	}
+	path := SESSION_STREAM
+	if len(query) > 0 {
+		path += "?" + strings.Join(query, "&")
+	}
+	resp := cli.get(path)
+	if resp.StatusCode != http.StatusOK {
+		output(resp)
+		return nil
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	event := ""
+	data := []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+		} else if value, ok := strings.CutPrefix(line, "data: "); ok {
+			data = append(data, value)
+		} else if line == "" && event != "" {
+			fmt.Println(strings.Join(data, "\n"))
+			if event == STREAM_FAILURE {
+				exitCode = 1
+				return nil
+			} else if event == STREAM_STOPPING {
+				return nil
+			}
+			event = ""
+			data = data[:0]
+		}
+	}
+	return nil
+}
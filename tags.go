@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leisure-tools/server"
+)
+
+const DOC_TAGS = server.VERSION + "/doc/tags/"
+
+var ErrUnknownTag = server.NewLeisureError("unknownTag")
+
+// versionTag names a version of a document by the hash of its text, the same hash
+// DOC_GET takes. The text is kept with the tag so the version outlives the peer's caches.
+type versionTag struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	Author  string    `json:"author,omitempty"`
+	Text    string    `json:"text,omitempty"`
+}
+
+// documentTags maps documents to their tags by name
+type documentTags map[string]map[string]*versionTag
+
+func textHash(text string) string {
+	hash := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(hash[:])
+}
+
+// withoutText is the tag as the API lists it
+func (tag *versionTag) withoutText() *versionTag {
+	result := *tag
+	result.Text = ""
+	return &result
+}
+
+// newer is true if tag should replace old, the later tag wins when they name different versions
+func (tag *versionTag) newer(old *versionTag) bool {
+	return old == nil || (old.Hash != tag.Hash && old.Created.Before(tag.Created))
+}
+
+// addTag names a version of a document, the latest one if the tag has no hash or text,
+// called in the service goroutine
+func (l *leisure) addTag(docId string, tag *versionTag) (*versionTag, error) {
+	h := l.Documents[docId]
+	if h == nil {
+		return nil, fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, docId)
+	}
+	switch {
+	case tag.Text != "":
+		hash := textHash(tag.Text)
+		if tag.Hash != "" && tag.Hash != hash {
+			return nil, fmt.Errorf("%w: text does not match hash %s", ErrBadCommand, tag.Hash)
+		}
+		tag.Hash = hash
+	case tag.Hash != "":
+		var hash [sha256.Size]byte
+		if n, err := hex.Decode(hash[:], []byte(tag.Hash)); err != nil || n != len(hash) {
+			return nil, fmt.Errorf("%w: bad document hash %s", ErrBadCommand, tag.Hash)
+		} else if tag.Text = h.GetDocument(hash); tag.Text == "" {
+			return nil, fmt.Errorf("%w: no version %s of document %s", ErrUnknownTag, tag.Hash, docId)
+		}
+	default:
+		tag.Text = h.GetLatestDocument().String()
+		tag.Hash = textHash(tag.Text)
+	}
+	if tag.Created.IsZero() {
+		tag.Created = time.Now().UTC()
+	}
+	// DOC_GET finds versions by hash in the document's storage
+	h.Storage.StoreDocument(tag.Text)
+	if l.tags[docId] == nil {
+		l.tags[docId] = map[string]*versionTag{}
+	}
+	l.tags[docId][tag.Name] = tag
+	l.index.indexTag(docId, tag)
+	if l.store != nil {
+		l.store.saveTags(docId)
+	}
+	return tag, nil
+}
+
+// URL: GET /v1/doc/tags/DOC -- DOC's tags, oldest first
+// URL: GET /v1/doc/tags/DOC/NAME -- one tag
+// URL: POST /v1/doc/tags/DOC -- body {"name": NAME, "hash": HASH}, tags the latest version if
+// the hash is missing, replicating peers with this peer's token send the version's text as well
+func (l *leisure) tagsHandler(w http.ResponseWriter, r *http.Request) {
+	doc, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, DOC_TAGS), "/")
+	doc, name = unescape(doc), unescape(name)
+	user := identity(r)
+	tag := &versionTag{}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(tag); err != nil || tag.Name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: expected {\"name\": NAME, \"hash\": HASH}", ErrBadCommand))))
+			return
+		}
+		setDefault(&tag.Author, user)
+		if tag.Text != "" && !hasPeerAccess(r) {
+			// anyone else could name text that was never a version of the document
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(server.ErrorJSON(fmt.Errorf("%w: only peers with this peer's token can send a version's text", ErrForbidden))))
+			return
+		}
+	}
+	var result any
+	var err error
+	l.sync(func() {
+		docId := l.docId(doc)
+		if docId == "" {
+			err = fmt.Errorf("%w: no document %s", server.ErrUnknownDocument, doc)
+			return
+		}
+		needed := ROLE_VIEWER
+		if r.Method == http.MethodPost {
+			needed = ROLE_EDITOR
+		}
+		if role := l.roleFor(docId, user); !hasRole(role, needed) {
+			err = forbidden(user, role, docId, needed)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost:
+			if tag, err = l.addTag(docId, tag); err == nil {
+				result = tag.withoutText()
+			}
+		case name != "":
+			if tag := l.tags[docId][name]; tag == nil {
+				err = fmt.Errorf("%w: no tag %s on document %s", ErrUnknownTag, name, docId)
+			} else {
+				result = tag.withoutText()
+			}
+		default:
+			tags := []*versionTag{}
+			for _, tag := range l.tags[docId] {
+				tags = append(tags, tag.withoutText())
+			}
+			sort.Slice(tags, func(i, j int) bool { return tags[i].Created.Before(tags[j].Created) })
+			result = tags
+		}
+	})
+	switch server.ErrorType(err) {
+	case "":
+		writeJSON(w, result)
+	case ErrForbidden.Type:
+		writeForbidden(w, err)
+	case ErrUnknownTag.Type, server.ErrUnknownDocument.Type:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(server.ErrorJSON(err)))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(server.ErrorJSON(err)))
+	}
+}
+
+// syncTags exchanges a document's tags with the remote peer, sending versions the other
+// side may not have along with them
+func (r *replicator) syncTags(rd *replicaDoc) error {
+	var remoteList []*versionTag
+	if err := r.call(rd.client, http.MethodGet, DOC_TAGS+url.PathEscape(rd.docId), nil, &remoteList); err != nil {
+		return err
+	}
+	remote := map[string]*versionTag{}
+	for _, tag := range remoteList {
+		remote[tag.Name] = tag
+	}
+	var send, fetch []*versionTag
+	r.sync(func() {
+		local := r.tags[rd.docId]
+		for name, tag := range local {
+			if tag.newer(remote[name]) {
+				send = append(send, tag)
+			}
+		}
+		for name, tag := range remote {
+			if tag.newer(local[name]) {
+				fetch = append(fetch, tag)
+			}
+		}
+	})
+	for _, tag := range send {
+		if err := r.call(rd.client, http.MethodPost, DOC_TAGS+url.PathEscape(rd.docId), tag, nil); server.ErrorType(err) == ErrForbidden.Type {
+			// the link's token is not the remote peer's own
+			r.logger.Debug("remote refused tag", "document", rd.docId, "tag", tag.Name, "error", err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		r.logger.Debug("sent tag", "document", rd.docId, "tag", tag.Name)
+	}
+	for _, tag := range fetch {
+		if err := r.call(rd.client, http.MethodGet, server.DOC_GET+url.PathEscape(rd.docId)+"?hash="+tag.Hash, nil, &tag.Text); err != nil {
+			return err
+		}
+		var err error
+		r.sync(func() { _, err = r.addTag(rd.docId, tag) })
+		if err != nil {
+			return err
+		}
+		r.logger.Debug("received tag", "document", rd.docId, "tag", tag.Name)
+	}
+	return nil
+}
+
+func (cmd *DocTagCmd) Run(cli *CLI) error {
+	body, _ := json.Marshal(&versionTag{Name: cmd.Name, Hash: cmd.Hash})
+	output(cli.request(http.MethodPost, bytes.NewReader(body), DOC_TAGS, cmd.Doc))
+	return nil
+}
+
+func (cmd *DocTagsCmd) Run(cli *CLI) error {
+	output(cli.get(DOC_TAGS, cmd.Doc))
+	return nil
+}
+
+// tagHash finds the hash for a tag on a document, printing the peer's error if there is none
+func (cli *CLI) tagHash(doc, name string) (string, bool) {
+	resp := cli.get(DOC_TAGS, doc, name)
+	if resp.StatusCode != http.StatusOK {
+		output(resp)
+		return "", false
+	}
+	defer resp.Body.Close()
+	tag := &versionTag{}
+	if err := json.NewDecoder(resp.Body).Decode(tag); err != nil {
+		panicWith("%w: bad tag from peer: %s", ErrBadCommand, err)
+	}
+	return tag.Hash, true
+}
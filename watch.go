@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/leisure-tools/history"
+	"github.com/leisure-tools/org"
+	"github.com/leisure-tools/server"
+)
+
+const WATCH_INTERVAL = time.Second
+
+var ErrWatch = server.NewLeisureError("watchFailure")
+
+// fileWatcher keeps the org files in a directory in sync with documents.
+// Each file is a document aliased by its path relative to the directory and
+// has a WATCH-PATH session that carries the file's edits into the history.
+// The watcher polls because the peer has no file notification dependency.
+type fileWatcher struct {
+	*leisure
+	dir    string
+	logger *slog.Logger
+	files  map[string]*watchedFile
+}
+
+type watchedFile struct {
+	path    string // relative to the watched directory
+	docId   string
+	session *server.LeisureSession
+	modTime time.Time
+	text    string // contents last read from or written to disk
+	heads   []history.Sha
+}
+
+func newFileWatcher(l *leisure, dir string) (*fileWatcher, error) {
+	if info, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("%w: could not open directory %s: %s", ErrWatch, dir, err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%w: not a directory: %s", ErrWatch, dir)
+	}
+	return &fileWatcher{
+		leisure: l,
+		dir:     dir,
+		logger:  logFor(LOG_PEER).With("watch", dir),
+		files:   map[string]*watchedFile{},
+	}, nil
+}
+
+func (w *fileWatcher) run() {
+	for !w.stopping.Load() {
+		w.scan()
+		time.Sleep(WATCH_INTERVAL)
+	}
+}
+
+// scan imports new files, commits external edits, and writes merged documents
+func (w *fileWatcher) scan() {
+	seen := map[string]fs.FileInfo{}
+	filepath.WalkDir(w.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(name, ".org") || strings.HasPrefix(d.Name(), ".#") {
+			return nil
+		}
+		if rel, err := filepath.Rel(w.dir, name); err == nil {
+			if info, err := d.Info(); err == nil {
+				seen[filepath.ToSlash(rel)] = info
+			}
+		}
+		return nil
+	})
+	for rel := range w.files {
+		if seen[rel] == nil {
+			w.logger.Debug("stopped watching", "file", rel)
+			delete(w.files, rel)
+		}
+	}
+	for rel, info := range seen {
+		w.sync(func() {
+			if w.stopping.Load() {
+				// the store may already be closed
+				return
+			}
+			defer func() {
+				if err := recover(); err != nil {
+					w.logger.Error("could not check file", "file", rel, "error", err)
+				}
+			}()
+			w.check(rel, info)
+		})
+	}
+}
+
+// check one file, called in the service goroutine
+func (w *fileWatcher) check(rel string, info fs.FileInfo) {
+	wf := w.files[rel]
+	if wf == nil {
+		wf = w.importFile(rel)
+		if wf == nil {
+			return
+		}
+	}
+	h := w.Documents[wf.docId]
+	if h == nil {
+		// the document went away, import the file again on the next scan unless it was deleted
+		delete(w.files, rel)
+		return
+	}
+	changed := false
+	if !info.ModTime().Equal(wf.modTime) {
+		wf.modTime = info.ModTime()
+		if buf, err := os.ReadFile(filepath.Join(w.dir, rel)); err != nil {
+			panic(err)
+		} else if text := string(buf); text != wf.text {
+			w.logger.Debug("file changed", "file", rel)
+			for _, repl := range textEdits(wf.text, text) {
+				wf.session.Replace(repl.Offset, repl.Length, repl.Text)
+			}
+			wf.text = text
+			changed = true
+		}
+	}
+	if !changed && slices.Equal(wf.heads, h.LatestHashes()) {
+		return
+	}
+	if _, _, _, err := wf.session.Commit(0, 0, &org.ChunkChanges{}); err != nil {
+		panic(err)
+	}
+	wf.heads = slices.Clone(h.LatestHashes())
+	if merged := h.GetLatestDocument().String(); merged != wf.text {
+		w.writeFile(wf, merged)
+	}
+}
+
+// importFile shares a file as a document, reusing a document with the same alias
+func (w *fileWatcher) importFile(rel string) *watchedFile {
+	id := w.DocumentAliases[rel]
+	if (id == "" || w.Documents[id] == nil) && w.deletedAlias(rel) {
+		// the file's document was deleted, leave it deleted
+		return nil
+	}
+	buf, err := os.ReadFile(filepath.Join(w.dir, rel))
+	if err != nil {
+		panic(err)
+	}
+	text := string(buf)
+	if id == "" || w.Documents[id] == nil {
+		key := make([]byte, 16)
+		rand.Read(key)
+		id = hex.EncodeToString(key)
+		w.logger.Debug("importing file", "file", rel, "document", id)
+		w.addDocument(id, rel, text)
+	}
+	h := w.Documents[id]
+	sessionId := "WATCH-" + rel
+	session := w.Sessions[sessionId]
+	if session == nil {
+		if session, err = w.AddSession(sessionId, h, false, true, false, 0); err != nil {
+			panic(err)
+		}
+	}
+	wf := &watchedFile{
+		path:    rel,
+		docId:   id,
+		session: session,
+		text:    text,
+	}
+	if info, err := os.Stat(filepath.Join(w.dir, rel)); err == nil {
+		wf.modTime = info.ModTime()
+	}
+	if latest := h.GetLatestDocument().String(); latest != text {
+		// the document already existed, so the file holds external edits
+		for _, repl := range textEdits(latest, text) {
+			session.Replace(repl.Offset, repl.Length, repl.Text)
+		}
+	}
+	w.files[rel] = wf
+	return wf
+}
+
+// writeFile replaces the file atomically so editors never see a partial write
+func (w *fileWatcher) writeFile(wf *watchedFile, text string) {
+	name := filepath.Join(w.dir, wf.path)
+	mode := fs.FileMode(0644)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := filepath.Join(filepath.Dir(name), ".#leisure-"+filepath.Base(name))
+	if err := os.WriteFile(tmp, []byte(text), mode); err != nil {
+		panic(err)
+	} else if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		panic(err)
+	} else if info, err := os.Stat(name); err == nil {
+		wf.modTime = info.ModTime()
+	}
+	w.logger.Debug("wrote file", "file", wf.path)
+	wf.text = text
+}
+
+// textEdits returns a replacement that turns oldText into newText
+// by trimming their common prefix and suffix, keeping runes whole
+func textEdits(oldText, newText string) []history.Replacement {
+	if oldText == newText {
+		return nil
+	}
+	start := 0
+	for start < len(oldText) && start < len(newText) && oldText[start] == newText[start] {
+		start++
+	}
+	for start > 0 && start < len(oldText) && !utf8.RuneStart(oldText[start]) {
+		start--
+	}
+	oldEnd, newEnd := len(oldText), len(newText)
+	for oldEnd > start && newEnd > start && oldText[oldEnd-1] == newText[newEnd-1] {
+		oldEnd--
+		newEnd--
+	}
+	for oldEnd < len(oldText) && !utf8.RuneStart(oldText[oldEnd]) {
+		oldEnd++
+		newEnd++
+	}
+	return []history.Replacement{{Offset: start, Length: oldEnd - start, Text: newText[start:newEnd]}}
+}